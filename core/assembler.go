@@ -0,0 +1,189 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+
+	"github.com/shepheb/psec"
+)
+
+// DriverFactory constructs a machine's Driver, with a parser that reports back
+// to the given Assembler. Each machine package exports one as NewDriver.
+type DriverFactory func(a *Assembler) Driver
+
+// Options tunes an Assembler. The zero value gives the defaults.
+type Options struct {
+	// Defines are symbols set before the source begins, like -D on the
+	// command line.
+	Defines map[string]uint32
+	// IncludePaths are searched in order for included files: after the
+	// including file's directory for .include "file", and alone for
+	// .include <file>. Like -I on the command line.
+	IncludePaths []string
+	// Fill is written in the gaps between regions of the ROM image.
+	Fill uint16
+}
+
+// Assembler holds everything a single assembly needs: the machine driver and
+// its parser, the macro table, the machine's reserved words, and the functions
+// expressions can call.
+//
+// Separate Assemblers share no state, so they can run concurrently, even for
+// different machines. A single Assembler runs one assembly at a time.
+type Assembler struct {
+	Options Options
+
+	driver    Driver
+	macros    map[string]*macro
+	reserved  ReservedWordsFn
+	registers []string
+	functions map[string]Function
+	// Symbols the machine driver defines before the source begins.
+	predefined map[string]uint32
+
+	// The .include directives for the files being parsed, outermost first.
+	including []*psec.Loc
+	// The canonical paths of the files parsed so far, and of those with .once.
+	parsed map[string]bool
+	once   map[string]bool
+
+	// The text of every file and macro expansion parsed so far, split into
+	// lines, for the listing.
+	sources map[string][]string
+}
+
+// NewAssembler creates an Assembler for the machine built by the factory.
+func NewAssembler(machine DriverFactory, opts Options) *Assembler {
+	a := &Assembler{
+		Options:    opts,
+		macros:     map[string]*macro{},
+		reserved:   func(ident string) bool { return false },
+		functions:  builtinFunctions(),
+		predefined: map[string]uint32{},
+		sources:    map[string][]string{},
+		parsed:     map[string]bool{},
+		once:       map[string]bool{},
+	}
+	a.driver = machine(a)
+	return a
+}
+
+// Driver returns the machine driver this Assembler parses with.
+func (a *Assembler) Driver() Driver { return a.driver }
+
+// SetReservedWords should be called by the machine's driver, defining which
+// identifiers are illegal as labels and symbols.
+func (a *Assembler) SetReservedWords(fn ReservedWordsFn) {
+	a.reserved = fn
+}
+
+// SetRegisterNames should be called by the machine's driver with the names of
+// its registers, so labels that only differ from them in case can be warned
+// about. Registers are matched in any case, so those labels can't be used as
+// arguments.
+func (a *Assembler) SetRegisterNames(names ...string) {
+	a.registers = names
+}
+
+// Predefine sets a symbol before the source begins, for names the machine
+// provides, like the DCPU's colours. Options.Defines and the source can redefine
+// them, and they're left out of the symbol table.
+func (a *Assembler) Predefine(name string, value uint32) {
+	a.predefined[name] = value
+}
+
+// Source is the input to an assembly. If Text is nil, Filename is read from
+// disk; otherwise Filename is only used for error messages.
+type Source struct {
+	Filename string
+	Text     []byte
+}
+
+// Result is the output of an assembly.
+type Result struct {
+	// Segments are the runs of words actually written, in address order, and
+	// Regions describe them for the -map report.
+	Segments    []Segment
+	Regions     []Region
+	Diagnostics Diagnostics
+	// Listing records what each top-level line assembled to on the final pass.
+	Listing []*Emission
+	// Symbols holds the final value of every label and symbol.
+	Symbols []Symbol
+
+	// For ROM: the gap value, and the address just past the last word written.
+	// That can be $100000000, so it's a uint64.
+	fill uint16
+	end  uint64
+}
+
+// ROM builds the image from address 0 up to the last word written, with any
+// gaps filled with Options.Fill. It's built from the Segments on each call, so
+// an assembly that uses high addresses doesn't pay for a dense image unless
+// it's asked for. It's nil if the image would be over maxImageWords; use the
+// Segments for that.
+func (r *Result) ROM() []uint16 {
+	if r.end > maxImageWords {
+		return nil
+	}
+	return imageOf(r.Segments, uint32(r.end), r.fill)
+}
+
+// Error for Diagnostics summarizes every diagnostic, one per line.
+func (ds Diagnostics) Error() string {
+	msgs := make([]string, len(ds))
+	for i, d := range ds {
+		msgs[i] = d.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Assemble parses and assembles the source. It returns an error if the source
+// fails to parse, if the context is cancelled, or if the assembly reported any
+// errors. In the last case the Result is returned as well, with the errors in
+// its Diagnostics. A parse error is returned as Diagnostics too, with where the
+// parser stopped.
+func (a *Assembler) Assemble(ctx context.Context, src Source) (*Result, error) {
+	a.macros = map[string]*macro{}
+	a.sources = map[string][]string{}
+	a.including = nil
+	a.parsed = map[string]bool{canonicalPath(src.Filename): true}
+	a.once = map[string]bool{}
+
+	var ast *AST
+	var err error
+	if src.Text != nil {
+		ast, err = a.parseString(src.Filename, string(src.Text))
+	} else {
+		ast, err = a.parseFile(src.Filename)
+	}
+	if err != nil {
+		return nil, Diagnostics{parseDiagnostic(err)}
+	}
+
+	res, err := a.assembleAst(ctx, ast)
+	if err != nil {
+		return nil, err
+	}
+	if res.Diagnostics.HasErrors() {
+		return res, res.Diagnostics
+	}
+	return res, nil
+}
+
+// parseFile reads and parses a source file, keeping its text for the listing.
+func (a *Assembler) parseFile(filename string) (*AST, error) {
+	a.parsed[canonicalPath(filename)] = true
+	text, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return a.parseString(filename, string(text))
+}
+
+// parseString parses source text, keeping it for the listing.
+func (a *Assembler) parseString(filename, text string) (*AST, error) {
+	a.sources[filename] = strings.Split(text, "\n")
+	return a.driver.ParseString(filename, text)
+}
@@ -2,7 +2,6 @@ package core
 
 import (
 	"fmt"
-	"os"
 
 	"github.com/shepheb/psec"
 )
@@ -26,11 +25,27 @@ func LowWord(x uint32) uint16 {
 // AST captures a complete syntax tree for an assembled file.
 type AST struct {
 	Lines []Assembled
+	// Locs holds the source line each of Lines came from. It can be nil for
+	// hand-built ASTs.
+	Locs []*psec.Loc
 }
 
+func (a *AST) add(line Assembled, loc *psec.Loc) {
+	a.Lines = append(a.Lines, line)
+	a.Locs = append(a.Locs, loc)
+}
+
+// Assemble for AST assembles each line in turn, recording what each one emits
+// for the listing.
 func (a *AST) Assemble(s *AssemblyState) {
-	for _, line := range a.Lines {
+	for i, line := range a.Lines {
+		var loc *psec.Loc
+		if i < len(a.Locs) {
+			loc = a.Locs[i]
+		}
+		s.beginLine(line, loc)
 		line.Assemble(s)
+		s.endLine()
 	}
 }
 
@@ -54,7 +69,7 @@ func Evaluate16(e Expression, s *AssemblyState) uint16 {
 	if Fits16(value) || Fits16Signed(value) {
 		return LowWord(value)
 	}
-	AsmError(e.Location(), "expression value does not fit in 16 bits: %d ($%x)", value)
+	s.Errorf(e.Location(), "expression value does not fit in 16 bits: %d ($%x)", value, value)
 	return 0
 }
 
@@ -65,10 +80,14 @@ func UseLabel(label string, loc *psec.Loc) *LabelUse {
 
 // Evaluate resolves the value of a label when it appears in an expression.
 func (l *LabelUse) Evaluate(s *AssemblyState) uint32 {
-	value, _, known := s.lookup(l.label)
+	value, defined, known := s.lookup(l.label)
 	if !known {
-		AsmError(l.loc, "Unknown label '%s'", l.label)
-		os.Exit(1)
+		s.Errorf(l.loc, "Unknown label '%s'", s.qualify(l.label))
+	} else if !defined {
+		// Forward references are undefined until their first pass, but by the
+		// final pass only labels in skipped conditional blocks are left.
+		s.Errorf(l.loc, "Label '%s' is only defined in a skipped conditional block",
+			s.qualify(l.label))
 	}
 	return value
 }
@@ -82,6 +101,43 @@ func (l *LabelUse) Equals(expr Expression) bool {
 	return ok && l.label == l2.label
 }
 
+// NumericLabelUse refers to the next (1f) or previous (1b) numeric label :1.
+type NumericLabelUse struct {
+	label   string
+	forward bool
+	loc     *psec.Loc
+}
+
+// Evaluate for NumericLabelUse finds the label by counting the ones with the
+// same number so far this pass.
+func (u *NumericLabelUse) Evaluate(s *AssemblyState) uint32 {
+	n := s.numbered[u.label]
+	if u.forward {
+		n++
+	}
+	value, _, known := s.lookup(numberedName(u.label, n))
+	if !known {
+		s.Errorf(u.loc, "Unknown label '%s'", u.String())
+	}
+	return value
+}
+
+func (u *NumericLabelUse) String() string {
+	if u.forward {
+		return u.label + "f"
+	}
+	return u.label + "b"
+}
+
+// Location for NumericLabelUse
+func (u *NumericLabelUse) Location() *psec.Loc { return u.loc }
+
+// Equals for NumericLabelUse
+func (u *NumericLabelUse) Equals(expr Expression) bool {
+	u2, ok := expr.(*NumericLabelUse)
+	return ok && u.label == u2.label && u.forward == u2.forward
+}
+
 // Constant is a fixed-value Expression.
 type Constant struct {
 	Value uint32
@@ -100,6 +156,24 @@ func (c *Constant) Equals(expr Expression) bool {
 	return ok && c.Value == c2.Value
 }
 
+// Char is a character literal, like 'A'.
+type Char struct {
+	Value rune
+	Loc   *psec.Loc
+}
+
+// Evaluate for Char gives the character's code in the active charmap.
+func (c *Char) Evaluate(s *AssemblyState) uint32 { return s.MapChar(c.Value, c.Loc) }
+
+// Location for Char
+func (c *Char) Location() *psec.Loc { return c.Loc }
+
+// Equals for Char
+func (c *Char) Equals(expr Expression) bool {
+	c2, ok := expr.(*Char)
+	return ok && c.Value == c2.Value
+}
+
 // BinExpr represents a binary express, such as addition.
 type BinExpr struct {
 	lhs      Expression
@@ -113,9 +187,17 @@ func Binary(lhs Expression, op Operator, rhs Expression) *BinExpr {
 }
 
 // Evaluate for BinExpr recursively computes the left and right sides and
-// performs the operation.
+// performs the operation. Comparisons and logical operators give 1 or 0, and
+// && and || only evaluate the right side if they need it.
 func (b *BinExpr) Evaluate(s *AssemblyState) uint32 {
 	l := b.lhs.Evaluate(s)
+	switch b.operator {
+	case LAND:
+		return boolValue(l != 0 && b.rhs.Evaluate(s) != 0)
+	case LOR:
+		return boolValue(l != 0 || b.rhs.Evaluate(s) != 0)
+	}
+
 	r := b.rhs.Evaluate(s)
 	switch b.operator {
 	case PLUS:
@@ -124,8 +206,35 @@ func (b *BinExpr) Evaluate(s *AssemblyState) uint32 {
 		return l - r
 	case TIMES:
 		return l * r
-	case DIVIDE:
+	case DIVIDE, MOD:
+		if r == 0 {
+			s.Errorf(b.rhs.Location(), "division by zero")
+			return 0
+		}
+		if b.operator == MOD {
+			return l % r
+		}
 		return l / r
+	case EQ:
+		return boolValue(l == r)
+	case NE:
+		return boolValue(l != r)
+	case LT:
+		return boolValue(l < r)
+	case LE:
+		return boolValue(l <= r)
+	case GT:
+		return boolValue(l > r)
+	case GE:
+		return boolValue(l >= r)
+	case SLT:
+		return boolValue(int32(l) < int32(r))
+	case SLE:
+		return boolValue(int32(l) <= int32(r))
+	case SGT:
+		return boolValue(int32(l) > int32(r))
+	case SGE:
+		return boolValue(int32(l) >= int32(r))
 	case LANGLES:
 		return l << r
 	case RANGLES:
@@ -153,8 +262,44 @@ func (b *BinExpr) Equals(expr Expression) bool {
 		b.operator == b2.operator
 }
 
+func boolValue(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// TernaryExpr is C's cond ? then : else.
+type TernaryExpr struct {
+	cond Expression
+	then Expression
+	els  Expression
+}
+
+// Ternary constructs a conditional expression AST node.
+func Ternary(cond, then, els Expression) *TernaryExpr {
+	return &TernaryExpr{cond, then, els}
+}
+
+// Evaluate for TernaryExpr only evaluates the branch it picks.
+func (t *TernaryExpr) Evaluate(s *AssemblyState) uint32 {
+	if t.cond.Evaluate(s) != 0 {
+		return t.then.Evaluate(s)
+	}
+	return t.els.Evaluate(s)
+}
+
+// Location for TernaryExpr
+func (t *TernaryExpr) Location() *psec.Loc { return t.cond.Location() }
+
+// Equals for TernaryExpr
+func (t *TernaryExpr) Equals(expr Expression) bool {
+	t2, ok := expr.(*TernaryExpr)
+	return ok && t.cond.Equals(t2.cond) && t.then.Equals(t2.then) && t.els.Equals(t2.els)
+}
+
 // UnaryExpr captures a unary expression. There aren't as many of these, but
-// there are unary + and -, and unary bitwise NOT.
+// there are unary + and -, unary bitwise NOT, and logical !.
 type UnaryExpr struct {
 	operator Operator
 	expr     Expression
@@ -175,6 +320,8 @@ func (u *UnaryExpr) Evaluate(s *AssemblyState) uint32 {
 		return -value
 	case NOT:
 		return 0xffffffff ^ value
+	case LNOT:
+		return boolValue(value == 0)
 	default:
 		panic(fmt.Sprintf("unknown unary operation"))
 	}
@@ -207,20 +354,24 @@ func (i *Include) Assemble(s *AssemblyState) {
 // Org directives set the destination of all following assembled code.
 type Org struct{ Abs Expression }
 
-// Assemble for Org moves the state's index.
+// Assemble for Org moves the state's index. It also ends the data of the labels
+// before it, for sizeof.
 func (o *Org) Assemble(s *AssemblyState) {
+	s.endSizes()
 	s.index = o.Abs.Evaluate(s)
+	s.wrapped = false
 }
 
 // SymbolDef defines an assembler constant. Symbols can be overridden.
 type SymbolDef struct {
 	name  string
 	value Expression
+	loc   *psec.Loc
 }
 
 // DefineSymbol constructs a SymbolDef node, for a .define directive.
-func DefineSymbol(name string, value Expression) *SymbolDef {
-	return &SymbolDef{name, value}
+func DefineSymbol(name string, value Expression, loc *psec.Loc) *SymbolDef {
+	return &SymbolDef{name, value, loc}
 }
 
 func (sd *SymbolDef) Compare(name string, value Expression) bool {
@@ -233,7 +384,32 @@ func (sd *SymbolDef) Compare(name string, value Expression) bool {
 // Assemble for SymbolDef recomputes the value of the symbol, in case it has
 // changed.
 func (d *SymbolDef) Assemble(s *AssemblyState) {
-	s.updateSymbol(d.name, d.value.Evaluate(s))
+	if cr, ok := s.constants[d.name]; ok {
+		s.Errorf(d.loc, "'%s' is a constant defined with .equ at %s:%d, and can't be redefined",
+			d.name, cr.loc.Filename, cr.loc.Line)
+		return
+	}
+	s.updateSymbol(d.name, d.value.Evaluate(s), d.loc)
+}
+
+// EquDef defines a constant with .equ. Unlike a SymbolDef, it's known before
+// it's defined, like a label, and redefining it with a different value is an
+// error.
+type EquDef struct {
+	name  string
+	value Expression
+	loc   *psec.Loc
+}
+
+// DefineConstant constructs an EquDef node, for an .equ directive.
+func DefineConstant(name string, value Expression, loc *psec.Loc) *EquDef {
+	return &EquDef{name, value, loc}
+}
+
+// Assemble for EquDef computes the constant's value, which takes another pass
+// if it's changed, for any uses before this.
+func (d *EquDef) Assemble(s *AssemblyState) {
+	s.updateConstant(d.name, d.value.Evaluate(s), d.loc)
 }
 
 // DatBlock is a sequence of expressions to be assembled literally.
@@ -243,8 +419,12 @@ type DatBlock struct{ Values []Expression }
 func (b *DatBlock) Assemble(s *AssemblyState) {
 	for _, v := range b.Values {
 		value := v.Evaluate(s)
+		if c, ok := v.(*Char); ok && value > 0xffff {
+			s.Errorf(v.Location(), "Character %U doesn't fit in a single word", c.Value)
+			break
+		}
 		if !Fits16(value) && !Fits16Signed(value) {
-			AsmError(v.Location(), "Dat value does not fit in a single word: %d", value)
+			s.Errorf(v.Location(), "Dat value does not fit in a single word: %d", value)
 			break
 		}
 		s.Push(LowWord(value))
@@ -282,18 +462,33 @@ func DefineLabel(label string, loc *psec.Loc) *LabelDef {
 // since reassembling the above code might have moved it.
 func (l *LabelDef) Assemble(s *AssemblyState) {
 	// Labels are collected in an earlier pass, but we need to note the current
-	// index as its value.
-	s.updateLabel(l.Label, s.index)
+	// index as its value. Numeric labels are only added here, since their names
+	// depend on the order they're assembled in.
+	name := s.labelName(l.Label)
+	if prev, ok := s.defined[name]; ok {
+		// The check before assembling has reported the ones written twice.
+		if prev == l.loc {
+			s.Errorf(l.loc, "Label '%s' is defined more than once by the same line; use a local or numeric label",
+				name)
+		} else if !s.duplicates[name] {
+			s.Errorf(l.loc, "Label '%s' is already defined at %s:%d", name, prev.Filename, prev.Line)
+		}
+		return
+	}
+	s.defined[name] = l.loc
+	s.addLabel(name, l.loc)
+	s.updateLabel(name, s.index)
+	s.measure(l.Label, s.labels[name])
 }
 
 type MacroDef struct {
-	name string
-	body string
+	name  string
+	macro *macro
 }
 
 func (m *MacroDef) Assemble(s *AssemblyState) {
 	// Update the cached definitions, so we get the current one.
-	addMacro(m.name, m.body)
+	s.asm.addMacro(m.name, m.macro)
 }
 
 type MacroUse struct {
@@ -305,18 +500,23 @@ type MacroUse struct {
 func (m *MacroUse) Assemble(s *AssemblyState) {
 	text, err := doMacro(s, m.macro, m.args)
 	if err != nil {
-		panic(fmt.Sprintf("broken macro: %v", err))
+		s.Errorf(m.loc, "broken macro: %v", err)
+		return
 	}
 
-	parsed, err := currentDriver.ParseString("macro", text)
+	// Each call site gets its own source name, so the listing can show the
+	// expanded text.
+	source := fmt.Sprintf("%s:%d (macro %s)", m.loc.Filename, m.loc.Line, m.macro)
+	parsed, err := s.asm.parseString(source, text)
 	if err != nil {
-		// TODO Errors from Assemble? Probably wise.
-		AsmError(m.loc, "Macro parse failed: %s\n", text)
-		os.Exit(1)
+		s.Errorf(m.loc, "Macro parse failed: %v\n%s", err, text)
+		return
 	}
 
-	collectLabels(parsed, s)
-	for _, asm := range parsed.Lines {
-		asm.Assemble(s)
-	}
+	// Collecting the labels mustn't move the scope the expansion's local labels
+	// are assembled in.
+	scope := s.scope
+	collectLabels(parsed, s, nil)
+	s.scope = scope
+	parsed.Assemble(s)
 }
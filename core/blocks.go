@@ -0,0 +1,143 @@
+package core
+
+import (
+	"fmt"
+
+	"github.com/shepheb/psec"
+)
+
+type markerKind int
+
+const (
+	markIf markerKind = iota
+	markElif
+	markElse
+	markLoop
+	markEnd
+)
+
+// blockMarker is a parsed line that opens, continues or closes a block: .if,
+// .elif, .else and .endif, or a loop like .rep and its end. The file parser
+// folds these into IfBlocks and loop blocks.
+type blockMarker struct {
+	kind markerKind
+	name string // The directive, for errors.
+	loc  *psec.Loc
+
+	cond Expression // For .if and .elif.
+
+	// For loops, the block, and its body for the lines up to the end.
+	block Assembled
+	body  *AST
+	end   string // The directive that ends the loop.
+
+	// Set when the marker doesn't fit its block, eg. an .else without an .if.
+	// Then the marker stays in the AST to report it.
+	err string
+}
+
+// Assemble for blockMarker reports a misplaced block directive. Well-formed
+// ones have been folded into blocks at parse time.
+func (m *blockMarker) Assemble(s *AssemblyState) {
+	s.Errorf(m.loc, "%s", m.err)
+}
+
+// blockFrame is an open block while folding.
+type blockFrame struct {
+	outer  *AST // Where the lines after the block go.
+	marker *blockMarker
+	end    string
+
+	// For conditionals, the latest .if or .elif, which the next branch attaches
+	// to.
+	last    *IfBlock
+	sawElse bool
+}
+
+// foldBlocks nests the lines inside block directives into their blocks. Every
+// block must be closed in the same file or macro body.
+func foldBlocks(lines []Assembled, locs []*psec.Loc) *AST {
+	top := &AST{}
+	cur := top
+	var stack []*blockFrame
+	// Misplaced markers go at the top level, so they're reported whichever
+	// branch is taken.
+	misplaced := func(m *blockMarker, format string, args ...interface{}) {
+		m.err = fmt.Sprintf(format, args...)
+		top.add(m, m.loc)
+	}
+
+	for i, line := range lines {
+		loc := locs[i]
+		m, ok := line.(*blockMarker)
+		if !ok {
+			cur.add(line, loc)
+			continue
+		}
+
+		switch m.kind {
+		case markIf:
+			b := &IfBlock{Cond: m.cond, Then: &AST{}}
+			cur.add(b, loc)
+			stack = append(stack, &blockFrame{outer: cur, marker: m, end: "endif", last: b})
+			cur = b.Then
+			continue
+		case markLoop:
+			cur.add(m.block, loc)
+			stack = append(stack, &blockFrame{outer: cur, marker: m, end: m.end})
+			cur = m.body
+			continue
+		}
+
+		var f *blockFrame
+		if len(stack) > 0 {
+			f = stack[len(stack)-1]
+		}
+		if m.kind == markEnd {
+			if f == nil || f.end != m.name {
+				misplaced(m, ".%s without .%s", m.name, openerOf(m.name))
+				continue
+			}
+			cur = f.outer
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		// .elif and .else
+		if f == nil || f.last == nil {
+			misplaced(m, ".%s without .if", m.name)
+			continue
+		}
+		if f.sawElse {
+			misplaced(m, ".%s after .else", m.name)
+			continue
+		}
+		if m.kind == markElif {
+			b := &IfBlock{Cond: m.cond, Then: &AST{}}
+			f.last.Else = &AST{}
+			f.last.Else.add(b, loc)
+			f.last = b
+			cur = b.Then
+		} else {
+			f.last.Else = &AST{}
+			f.sawElse = true
+			cur = f.last.Else
+		}
+	}
+
+	for _, f := range stack {
+		misplaced(f.marker, ".%s without .%s", f.marker.name, f.end)
+	}
+	return top
+}
+
+// openerOf names the directive that starts a block, given its end.
+func openerOf(end string) string {
+	switch end {
+	case "endr":
+		return "rep"
+	case "endfor":
+		return "for"
+	}
+	return "if"
+}
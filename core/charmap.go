@@ -0,0 +1,102 @@
+package core
+
+import "github.com/shepheb/psec"
+
+// defaultCharmap is the name of the charmap active at the start of each pass.
+// Unlike the named ones, it maps any character it has no entry for to itself.
+const defaultCharmap = "default"
+
+// charmap maps characters in strings and character literals to the codes
+// written for them, for fonts that don't match ASCII.
+type charmap struct {
+	name     string
+	chars    map[rune]uint32
+	identity bool // Unmapped characters map to themselves, rather than failing.
+}
+
+func newCharmap(name string) *charmap {
+	return &charmap{name: name, chars: map[rune]uint32{}, identity: name == defaultCharmap}
+}
+
+// MapChar gives the code for a character in the active charmap, or reports an
+// error at loc if it isn't in the map. Drivers with their own string directives
+// should use it for each character.
+func (s *AssemblyState) MapChar(c rune, loc *psec.Loc) uint32 {
+	if code, ok := s.charmap.chars[c]; ok {
+		return code
+	}
+	if !s.charmap.identity {
+		s.Errorf(loc, "Character %q isn't in charmap %s", c, s.charmap.name)
+	}
+	return uint32(c)
+}
+
+// CharmapDef adds characters to the active charmap: .charmap 'c', code maps one
+// character, .charmap 'a', 'z', code maps the range to consecutive codes.
+type CharmapDef struct {
+	First rune
+	Last  rune
+	Code  Expression
+	loc   *psec.Loc
+}
+
+// Assemble for CharmapDef adds its entries. Charmaps are rebuilt in order on
+// every pass, like symbols.
+func (d *CharmapDef) Assemble(s *AssemblyState) {
+	if d.Last < d.First {
+		s.Errorf(d.loc, "charmap range '%c' to '%c' is backwards", d.First, d.Last)
+		return
+	}
+	// Character literals in the code are taken as they're written too, like the
+	// characters being mapped, rather than through the charmap being built.
+	active := s.charmap
+	s.charmap = newCharmap(defaultCharmap)
+	code := d.Code.Evaluate(s)
+	s.charmap = active
+	for c := d.First; c <= d.Last; c++ {
+		s.charmap.chars[c] = code + uint32(c-d.First)
+	}
+}
+
+// SetCharmap switches to a named charmap, creating it empty the first time it's
+// used in a pass: .setcharmap name. The default charmap is named "default".
+type SetCharmap struct {
+	Name string
+}
+
+// Assemble for SetCharmap makes the charmap active.
+func (c *SetCharmap) Assemble(s *AssemblyState) {
+	m, ok := s.charmaps[c.Name]
+	if !ok {
+		m = newCharmap(c.Name)
+		s.charmaps[c.Name] = m
+	}
+	s.charmap = m
+}
+
+func addCharmapParsers(g *psec.Grammar) {
+	argSep := psec.Seq(ws(), lit(","), ws())
+	// The range form is tried first, since the code can be a character literal
+	// too, as in .charmap 'a', 'A' or .charmap 'a', 'A'+1.
+	g.WithAction("dir:charmap",
+		psec.Seq(litIC("charmap"), sym("ws1"), sym("char literal"),
+			psec.Alt(psec.Seq(argSep, sym("char literal"), argSep, sym("expr")),
+				psec.Seq(argSep, sym("expr")))),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			rs := r.([]interface{})
+			// The characters are taken as they're written, not through a charmap.
+			first := rs[2].(*Char).Value
+			last := first
+			args := rs[3].([]interface{})
+			if len(args) == 4 {
+				last = args[1].(*Char).Value
+			}
+			return &CharmapDef{First: first, Last: last, Code: args[len(args)-1].(Expression), loc: loc}, nil
+		})
+	g.WithAction("dir:setcharmap",
+		psec.SeqAt(2, litIC("setcharmap"), sym("ws1"), sym("identifier")),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			return &SetCharmap{Name: r.(string)}, nil
+		})
+	g.AddSymbol("dir:charmaps", psec.Alt(sym("dir:setcharmap"), sym("dir:charmap")))
+}
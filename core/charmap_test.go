@@ -0,0 +1,59 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCharmap(t *testing.T) {
+	_, res := assembleTest(t, `
+.dat "Az"
+.charmap 'A', 'Z', 0x80
+.charmap ' ', 0
+.dat "AZ ", 'B', 'z'
+.asciiz "C"
+.setcharmap digits
+.charmap '0', '9', 1
+.dat "90"
+.setcharmap default
+.dat 'A'`)
+	expectWords(t, res,
+		'A', 'z',
+		0x80, 0x99, 0, 0x81, 'z',
+		0x82, 0,
+		10, 1,
+		0x80)
+
+	// A code can be written as a character literal.
+	_, res = assembleTest(t, `
+.charmap 'a', 'B'
+.charmap 'b', 'A'+2
+.charmap 'x', 'z', 'X'
+.dat "abyc"`)
+	expectWords(t, res, 'B', 'C', 'Y', 'c')
+
+	// Even when the active charmap doesn't map them, or maps them elsewhere.
+	_, res = assembleTest(t, `
+.charmap 'A', 0
+.setcharmap font
+.charmap 'a', 'z', 'A'
+.charmap 'B', 'A'+1
+.dat "abB"`)
+	expectWords(t, res, 'A', 'B', 'B')
+}
+
+func TestCharmapErrors(t *testing.T) {
+	_, res := assembleTest(t, `
+.setcharmap digits
+.charmap '0', '9', 0
+.dat "1a"`)
+	if len(res.Diagnostics) != 1 || res.Diagnostics[0].Loc.Line != 4 ||
+		!strings.Contains(res.Diagnostics[0].Message, "'a' isn't in charmap digits") {
+		t.Errorf("expected an error for 'a' on line 4, got %v", res.Diagnostics)
+	}
+
+	_, res = assembleTest(t, `.charmap 'z', 'a', 0`)
+	if len(res.Diagnostics) != 1 || !strings.Contains(res.Diagnostics[0].Message, "backwards") {
+		t.Errorf("expected an error for a backwards range, got %v", res.Diagnostics)
+	}
+}
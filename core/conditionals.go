@@ -0,0 +1,84 @@
+package core
+
+import "github.com/shepheb/psec"
+
+// IfBlock is a conditional block: .if, optional .elif and .else, and .endif.
+// An .elif is an Else holding a single nested IfBlock.
+type IfBlock struct {
+	Cond Expression
+	Then *AST
+	Else *AST // nil when there's no .else or .elif
+}
+
+// Assemble for IfBlock evaluates the condition on every pass, and assembles
+// whichever branch it selects. Nonzero is true.
+func (b *IfBlock) Assemble(s *AssemblyState) {
+	if b.Cond.Evaluate(s) != 0 {
+		b.Then.Assemble(s)
+	} else if b.Else != nil {
+		b.Else.Assemble(s)
+	}
+}
+
+// Defined is the condition for .ifdef and .ifndef: 1 if the label or symbol has
+// been defined so far this pass, 0 if not.
+type Defined struct {
+	name string
+	not  bool // For .ifndef
+	loc  *psec.Loc
+}
+
+// Evaluate for Defined
+func (d *Defined) Evaluate(s *AssemblyState) uint32 {
+	if s.isDefined(d.name) != d.not {
+		return 1
+	}
+	return 0
+}
+
+// Location for Defined
+func (d *Defined) Location() *psec.Loc { return d.loc }
+
+// Equals for Defined
+func (d *Defined) Equals(expr Expression) bool {
+	d2, ok := expr.(*Defined)
+	return ok && d.name == d2.name && d.not == d2.not
+}
+
+func addConditionalParsers(g *psec.Grammar) {
+	g.WithAction("dir:if",
+		psec.SeqAt(2, litIC("if"), sym("ws1"), sym("expr")),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			return &blockMarker{kind: markIf, name: "if", loc: loc, cond: r.(Expression)}, nil
+		})
+	g.WithAction("dir:ifdef",
+		psec.SeqAt(2, litIC("ifdef"), sym("ws1"), sym("identifier")),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			return &blockMarker{kind: markIf, name: "ifdef", loc: loc,
+				cond: &Defined{name: r.(string), loc: loc}}, nil
+		})
+	g.WithAction("dir:ifndef",
+		psec.SeqAt(2, litIC("ifndef"), sym("ws1"), sym("identifier")),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			return &blockMarker{kind: markIf, name: "ifndef", loc: loc,
+				cond: &Defined{name: r.(string), not: true, loc: loc}}, nil
+		})
+	g.WithAction("dir:elif",
+		psec.SeqAt(2, litIC("elif"), sym("ws1"), sym("expr")),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			return &blockMarker{kind: markElif, name: "elif", loc: loc, cond: r.(Expression)}, nil
+		})
+	g.WithAction("dir:else", litIC("else"),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			return &blockMarker{kind: markElse, name: "else", loc: loc}, nil
+		})
+	g.WithAction("dir:endif", litIC("endif"),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			return &blockMarker{kind: markEnd, name: "endif", loc: loc}, nil
+		})
+
+	// Longer names first, so .ifdef isn't read as .if.
+	g.AddSymbol("dir:conditional",
+		psec.Alt(sym("dir:ifdef"), sym("dir:ifndef"), sym("dir:if"), sym("dir:elif"),
+			sym("dir:else"), sym("dir:endif")))
+}
@@ -0,0 +1,127 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIfElse(t *testing.T) {
+	_, res := assembleTest(t, `
+.def variant, 2
+.if variant - 1
+  .dat 1
+.else
+  .dat 2
+.endif
+.if variant - 2
+  .dat 3
+.elif variant
+  .dat 4
+  .if 0
+    .dat 5
+  .else
+    .dat 6
+  .endif
+.else
+  .dat 7
+.endif`)
+	expectWords(t, res, 1, 4, 6)
+}
+
+func TestIfdef(t *testing.T) {
+	src := `
+.ifdef DEBUG
+  .dat 0xdeb
+.endif
+.ifndef DEBUG
+  .dat 0x5e1
+.endif
+.if defined(DEBUG)
+  .dat DEBUG
+.endif`
+
+	_, res := assembleTest(t, src)
+	expectWords(t, res, 0x5e1)
+
+	a := NewAssembler(newTestDriver, Options{Defines: map[string]uint32{"DEBUG": 7}})
+	res, err := a.Assemble(context.Background(), Source{Filename: "test", Text: []byte(src)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectWords(t, res, 0xdeb, 7)
+}
+
+func TestIfForwardLabel(t *testing.T) {
+	// Conditions only see what's been defined so far, so a label later on isn't
+	// defined yet, and a guard around a label keeps its contents on every pass.
+	_, res := assembleTest(t, `
+.if defined(end)
+  .dat end
+.endif
+.ifndef foo
+:foo .dat 7
+.endif
+:end`)
+	expectWords(t, res, 7)
+}
+
+func TestIfSkippedLabel(t *testing.T) {
+	_, res := assembleTest(t, `
+.if 0
+:never .dat 1
+.endif
+.dat never`)
+	if len(res.Diagnostics) != 1 ||
+		!strings.Contains(res.Diagnostics[0].Message, "skipped conditional") {
+		t.Errorf("expected an error for the skipped label, got %v", res.Diagnostics)
+	}
+}
+
+func TestIfInMacro(t *testing.T) {
+	_, res := assembleTest(t, `
+.macro word=.if %0 %n .dat %0 %n .else %n .dat 0xffff %n .endif
+word 3
+word 0`)
+	expectWords(t, res, 3, 0xffff)
+}
+
+func TestIfInInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	inc := filepath.Join(dir, "inc.asm")
+	if err := ioutil.WriteFile(inc, []byte(".if big\n.dat 2\n.else\n.dat 1\n.endif\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, res := assembleTest(t, ".def big, 0\n.include \""+inc+"\"\n.def big, 1\n.include \""+inc+"\"")
+	expectWords(t, res, 1, 2)
+}
+
+func TestUnbalancedConditionals(t *testing.T) {
+	cases := []struct {
+		src  string
+		msg  string
+		line int
+	}{
+		{".if 1\n.dat 1", ".if without .endif", 1},
+		{".dat 1\n.endif", ".endif without .if", 2},
+		{".else", ".else without .if", 1},
+		{".if 1\n.else\n.else\n.endif", ".else after .else", 3},
+		{".if 1\n.else\n.elif 2\n.endif", ".elif after .else", 3},
+		{".if 1\n.dat 1\n.endif\n.ifdef x\n.dat 2", ".ifdef without .endif", 4},
+	}
+	for _, c := range cases {
+		_, res := assembleTest(t, c.src)
+		ds := res.Diagnostics
+		if len(ds) != 1 || ds[0].Message != c.msg || ds[0].Loc.Line != c.line {
+			t.Errorf("%q: expected %q on line %d, got %v", c.src, c.msg, c.line, ds)
+		}
+	}
+}
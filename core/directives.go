@@ -1,10 +1,22 @@
 package core
 
-import "github.com/shepheb/psec"
+import (
+	"strings"
+
+	"github.com/shepheb/psec"
+)
 
 // Shared psec parsers for the assembler directives.
-func addDirectiveParsers(g *psec.Grammar) {
-	addMacroParsers(g)
+func addDirectiveParsers(g *psec.Grammar, a *Assembler) {
+	addMacroParsers(g, a)
+	addConditionalParsers(g)
+	addLoopParsers(g)
+	addStringParsers(g)
+	addCharmapParsers(g)
+	addPaddingParsers(g)
+	addIncBinParsers(g)
+	addIncludeParsers(g, a)
+	addRegionParsers(g)
 	g.WithAction("dir:org",
 		psec.SeqAt(2, litIC("org"), sym("ws1"), sym("expr")),
 		func(r interface{}, loc *psec.Loc) (interface{}, error) {
@@ -25,19 +37,17 @@ func addDirectiveParsers(g *psec.Grammar) {
 			return &FillBlock{Value: &Constant{Value: 0}, Length: r.(Expression)}, nil
 		})
 
-	g.WithAction("dir:include",
-		psec.SeqAt(2, litIC("include"), sym("ws1"), sym("string")),
-		func(r interface{}, loc *psec.Loc) (interface{}, error) {
-			// Recursively parse the file.
-			return currentDriver.ParseFile(r.(string))
-		})
 	g.WithAction("dir:symbol",
 		psec.Seq(psec.Alt(litIC("symbol"), litIC("sym"), litIC("equ"),
 			litIC("set"), litIC("define"), litIC("def")),
 			sym("ws1"), sym("identifier"), ws(), lit(","), ws(), sym("expr")),
 		func(r interface{}, loc *psec.Loc) (interface{}, error) {
 			rs := r.([]interface{})
-			return DefineSymbol(rs[2].(string), rs[6].(Expression)), nil
+			// .equ is a constant, and the rest are symbols that can be redefined.
+			if strings.EqualFold(rs[0].(string), "equ") {
+				return DefineConstant(rs[2].(string), rs[6].(Expression), loc), nil
+			}
+			return DefineSymbol(rs[2].(string), rs[6].(Expression), loc), nil
 		})
 	g.WithAction("dir:dat",
 		psec.SeqAt(2, litIC("dat"), sym("ws1"),
@@ -48,27 +58,16 @@ func addDirectiveParsers(g *psec.Grammar) {
 				if expr, ok := value.(Expression); ok {
 					values = append(values, expr.(Expression))
 				} else if s, ok := value.(string); ok {
-					// Write each byte from the string into our DAT as a Constant.
-					for _, b := range s {
-						values = append(values, &Constant{Value: uint32(b)})
-					}
+					values = append(values, stringChars(s, loc)...)
 				}
 			}
 			return &DatBlock{Values: values}, nil
 		})
-	g.WithAction("dir:macro",
-		psec.Seq(litIC("macro"), sym("wsline"), sym("identifier"), sym("wsline"),
-			lit("="), psec.Stringify(psec.Many1(psec.NoneOf("\n")))),
-		func(r interface{}, loc *psec.Loc) (interface{}, error) {
-			rs := r.([]interface{})
-			ident := rs[2].(string)
-			body := rs[5].(string)
-			addMacro(ident, body)
-			return &MacroDef{name: ident, body: body}, nil
-		})
 
 	g.AddSymbol("directive",
 		psec.SeqAt(1, psec.Literal("."),
-			psec.Alt(sym("dir:fill"), sym("dir:reserve"), sym("dir:include"),
-				sym("dir:macro"), sym("dir:org"), sym("dir:dat"), sym("dir:symbol"))))
+			psec.Alt(sym("dir:fill"), sym("dir:reserve"), sym("dir:include"), sym("dir:once"),
+				sym("dir:incbins"), sym("dir:macro"), sym("dir:padding"), sym("dir:org"),
+				sym("dir:dat"), sym("dir:symbol"), sym("dir:conditional"), sym("dir:loop"),
+				sym("dir:strings"), sym("dir:charmaps"), sym("dir:overwrite"))))
 }
@@ -1,15 +1,52 @@
 package core
 
 import (
+	"context"
+	"io/ioutil"
 	"testing"
 
 	"github.com/shepheb/psec"
 )
 
-func buildParser() *psec.Grammar {
+// testDriver is a machine with no instructions besides macros, so the core
+// parsers and directives can be tested on their own.
+type testDriver struct {
+	g *psec.Grammar
+}
+
+func newTestDriver(a *Assembler) Driver {
 	g := psec.NewGrammar()
-	AddBasicParsers(g)
-	return g
+	AddBasicParsers(g, a)
+	g.AddSymbol("instruction", sym("macro use"))
+	return &testDriver{g: g}
+}
+
+func (d *testDriver) ParseFile(filename string) (*AST, error) {
+	text, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return d.ParseString(filename, string(text))
+}
+
+func (d *testDriver) ParseString(filename, text string) (*AST, error) {
+	ast, err := d.g.ParseString(filename, text)
+	if err != nil {
+		return nil, err
+	}
+	return ast.(*AST), nil
+}
+
+func (d *testDriver) ParseExpr(filename, text string) (Expression, error) {
+	expr, err := d.g.ParseStringWith(filename, text, "expr")
+	if err != nil {
+		return nil, err
+	}
+	return expr.(Expression), nil
+}
+
+func buildParser() *psec.Grammar {
+	return NewAssembler(newTestDriver, Options{}).Driver().(*testDriver).g
 }
 
 var p = buildParser()
@@ -29,3 +66,32 @@ func TestString(t *testing.T) {
 		}
 	}
 }
+
+// assembleTest assembles the source text with the test driver, and returns the
+// Assembler as well, for tests that need its listing or symbols.
+func assembleTest(t *testing.T, input string) (*Assembler, *Result) {
+	a := NewAssembler(newTestDriver, Options{})
+	res, err := a.Assemble(context.Background(), Source{Filename: "test", Text: []byte(input)})
+	if res == nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return a, res
+}
+
+// expectWords checks that an assembly succeeded and produced exactly the given
+// words.
+func expectWords(t *testing.T, res *Result, expected ...uint16) {
+	t.Helper()
+	if len(res.Diagnostics) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", res.Diagnostics)
+	}
+	rom := res.ROM()
+	if len(rom) != len(expected) {
+		t.Fatalf("expected %04x, got %04x", expected, rom)
+	}
+	for i, w := range expected {
+		if rom[i] != w {
+			t.Errorf("expected word %d to be %04x, got %04x", i, w, rom[i])
+		}
+	}
+}
@@ -1,8 +1,14 @@
 package core
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"os"
+	"strings"
+
+	"github.com/shepheb/psec"
 )
 
 type Driver interface {
@@ -11,88 +17,311 @@ type Driver interface {
 	ParseFile(filename string) (*AST, error)
 }
 
-// Used by Include to recursively parse.
-var currentDriver Driver
+// Outputs names the files MasterAssembler writes. Empty names are skipped.
+type Outputs struct {
+	Binary  string
+	Listing string
+	Symbols string
+	Map     string // The -map report of the regions written.
 
-// TODO This sucks and should be replaced by a payload on the parser.
-func SetDriver(machine Driver) {
-	currentDriver = machine
+	// Format is a key of OutputFormats; it defaults to "bin", raw big-endian.
+	Format string
+	// SymbolFormat is one of SymbolFormats; it defaults to "map".
+	SymbolFormat string
+	// Sparse writes only the regions that were written, rather than the whole
+	// image, for formats that are SparseFormats.
+	Sparse bool
 }
 
-func MasterAssembler(machine Driver, file, outfile string) {
-	currentDriver = machine
+// MasterAssembler parses and assembles the given file, and writes the outputs.
+// It returns the errors and warnings from the assembly. The binary is only
+// written if there were no errors, but the listing is always written, to help
+// track them down.
+func MasterAssembler(machine DriverFactory, file string, opts Options, outs Outputs) Diagnostics {
+	a := NewAssembler(machine, opts)
+	res, err := a.Assemble(context.Background(), Source{Filename: file})
+	if res == nil {
+		if diags, ok := err.(Diagnostics); ok {
+			return diags
+		}
+		return Diagnostics{{Severity: SeverityError, Message: err.Error()}}
+	}
+	diags := res.Diagnostics
 
-	FreshMacros()
-	ast, err := machine.ParseFile(file)
-	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		os.Exit(1)
+	if outs.Listing != "" {
+		if err := writeFile(outs.Listing, func(w io.Writer) error {
+			return a.WriteListing(w, res)
+		}); err != nil {
+			diags = append(diags, &Diagnostic{Severity: SeverityError, Message: err.Error()})
+		}
+	}
+	if diags.HasErrors() {
+		return diags
 	}
 
-	rom := AssembleAst(ast)
+	if outs.Symbols != "" {
+		format := outs.SymbolFormat
+		if format == "" {
+			format = "map"
+		}
+		if err := writeFile(outs.Symbols, func(w io.Writer) error {
+			return WriteSymbols(w, res.Symbols, format)
+		}); err != nil {
+			diags = append(diags, &Diagnostic{Severity: SeverityError, Message: err.Error()})
+		}
+	}
+	if outs.Map != "" {
+		if err := writeFile(outs.Map, func(w io.Writer) error {
+			return WriteMap(w, res.Regions)
+		}); err != nil {
+			diags = append(diags, &Diagnostic{Severity: SeverityError, Message: err.Error()})
+		}
+	}
+	if outs.Binary == "" {
+		return diags
+	}
 
-	// Now output the binary, big-endian.
-	// TODO: Flexible endianness.
-	// TODO: Include support.
-	out, _ := os.Create(outfile)
-	defer out.Close()
-	for _, w := range rom {
-		out.Write([]byte{byte(w >> 8), byte(w & 0xff)})
+	name := outs.Format
+	if name == "" {
+		name = "bin"
+	}
+	format, ok := OutputFormats[name]
+	if !ok {
+		return append(diags, &Diagnostic{Severity: SeverityError,
+			Message: fmt.Sprintf("unknown output format '%s'", name)})
+	}
+	var segs []Segment
+	if outs.Sparse {
+		if sf, ok := format.(SparseFormat); !ok || !sf.Sparse() {
+			return append(diags, &Diagnostic{Severity: SeverityError,
+				Message: fmt.Sprintf("output format '%s' can't write sparse output", name)})
+		}
+		segs = res.Segments
+	} else {
+		// Only build the whole image when it's needed, and not if it's huge.
+		if res.end > maxImageWords {
+			return append(diags, &Diagnostic{Severity: SeverityError,
+				Message: fmt.Sprintf("the output would run to $%x, %d words; "+
+					"use -sparse with ihex or srec for high addresses", res.end-1, res.end)})
+		}
+		segs = []Segment{{Start: 0, Words: res.ROM()}}
 	}
+	err = writeFile(outs.Binary, func(w io.Writer) error {
+		return format.Write(w, segs)
+	})
+	if err != nil {
+		diags = append(diags, &Diagnostic{Severity: SeverityError, Message: err.Error()})
+	}
+	return diags
+}
+
+// writeFile creates the named file and writes it with the given function.
+func writeFile(filename string, write func(w io.Writer) error) error {
+	out, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	if err := write(w); err != nil {
+		out.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
 }
 
-func AssembleAst(ast *AST) []uint16 {
-	s := new(AssemblyState)
+// AssembleAst assembles a parsed file. The Result holds the binary and symbol
+// table even if there were errors, along with the diagnostics from the final
+// pass.
+func (a *Assembler) AssembleAst(ast *AST) *Result {
+	res, _ := a.assembleAst(context.Background(), ast)
+	return res
+}
+
+func (a *Assembler) assembleAst(ctx context.Context, ast *AST) (*Result, error) {
+	s := &AssemblyState{asm: a, parsedBefore: copyFlags(a.parsed), onceBefore: copyFlags(a.once)}
 	s.labels = make(map[string]*labelRef)
+	s.constants = make(map[string]*labelRef)
+	s.duplicates = map[string]bool{}
 	s.reset()
-	collectLabels(ast, s)
-	assemble(ast, s)
-	return s.rom[:s.index]
+	collectLabels(ast, s, map[string]*psec.Loc{})
+	checkSymbols(ast, s)
+	if err := assemble(ctx, ast, s); err != nil {
+		return nil, err
+	}
+	// The image runs to the last word written, wherever the assembly ended.
+	segs := s.mem.Segments()
+	end := uint64(0)
+	if len(segs) > 0 {
+		last := segs[len(segs)-1]
+		end = uint64(last.Start) + uint64(len(last.Words))
+	}
+	return &Result{
+		Segments:    segs,
+		Regions:     s.regions(segs),
+		Diagnostics: append(s.checks, s.diags...),
+		Listing:     s.listing,
+		Symbols:     s.symbolTable(),
+		fill:        a.Options.Fill,
+		end:         end,
+	}, nil
 }
 
 // TODO: This might be better as a method on Assembled? Most of them are empty,
 // though.
-func collectLabels(ast *AST, s *AssemblyState) error {
+// Labels in macro expansions are collected as each expansion is assembled,
+// since the text depends on the arguments and state at that point. They're known
+// from then on, so earlier references to them resolve on the next pass.
+//
+// When defined is non-nil, it holds where each label was defined so far, and a
+// label defined again is reported in s.checks. The branches of an .if are
+// checked separately, since only one of them is assembled.
+func collectLabels(ast *AST, s *AssemblyState, defined map[string]*psec.Loc) error {
 	// Collect the labels.
 	for _, l := range ast.Lines {
 		if labelDef, ok := l.(*LabelDef); ok {
 			//fmt.Printf("Label: '%s'\n", labelDef.Label)
-			s.addLabel(labelDef.Label)
+			if !isNumericLabel(labelDef.Label) {
+				name := s.labelName(labelDef.Label)
+				s.addLabel(name, labelDef.loc)
+				if defined != nil {
+					s.checkLabel(name, labelDef.loc, defined)
+				}
+			}
+		} else if equ, ok := l.(*EquDef); ok {
+			s.addConstant(equ.name, equ.loc)
 		} else if ast, ok := l.(*AST); ok {
-			err := collectLabels(ast, s) // Recursively collect included files.
+			err := collectLabels(ast, s, defined) // Recursively collect included files.
 			if err != nil {
 				return err
 			}
-			//} else if mu, ok := l.(*MacroUse); ok {
-			//	// Recursively collect labels defined in macros.
-			//	text, err := doMacro(s, mu.macro, mu.args)
-			//	if err != nil {
-			//		return err
-			//	}
-			//	parsed, err := currentDriver.ParseString("macro", text)
-			//	if err != nil {
-			//		return err
-			//	}
-			//	collectLabels(parsed, s)
+		} else if b, ok := l.(*IfBlock); ok {
+			// Both branches, since the condition isn't known yet.
+			then := copyLocs(defined)
+			if err := collectLabels(b.Then, s, then); err != nil {
+				return err
+			}
+			if b.Else != nil {
+				els := copyLocs(defined)
+				if err := collectLabels(b.Else, s, els); err != nil {
+					return err
+				}
+				mergeLocs(defined, els)
+			}
+			mergeLocs(defined, then)
+		} else if b, ok := l.(*RepBlock); ok {
+			if err := collectLabels(b.Body, s, defined); err != nil {
+				return err
+			}
+		} else if b, ok := l.(*ForBlock); ok {
+			if err := collectLabels(b.Body, s, defined); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
-func assemble(ast *AST, s *AssemblyState) error {
+// checkLabel reports a label defined twice, with both places, and warns about
+// one that only differs from a register's name in case.
+func (s *AssemblyState) checkLabel(name string, loc *psec.Loc, defined map[string]*psec.Loc) {
+	if prev, ok := defined[name]; ok {
+		s.duplicates[name] = true
+		s.checks = append(s.checks, &Diagnostic{
+			Loc:      loc,
+			Severity: SeverityError,
+			Message: fmt.Sprintf("Label '%s' is already defined at %s:%d",
+				name, prev.Filename, prev.Line),
+		})
+		return
+	}
+	defined[name] = loc
+
+	for _, reg := range s.asm.registers {
+		if strings.EqualFold(name, reg) {
+			s.checks = append(s.checks, &Diagnostic{
+				Loc:      loc,
+				Severity: SeverityWarning,
+				Message:  fmt.Sprintf("Label '%s' looks like the register %s", name, reg),
+			})
+		}
+	}
+}
+
+// checkSymbols warns about each symbol with the same name as a label, which
+// hides it.
+func checkSymbols(ast *AST, s *AssemblyState) {
+	for _, l := range ast.Lines {
+		switch b := l.(type) {
+		case *SymbolDef:
+			s.checkSymbol(b.name, b.loc)
+		case *EquDef:
+			s.checkSymbol(b.name, b.loc)
+		case *AST:
+			checkSymbols(b, s)
+		case *IfBlock:
+			checkSymbols(b.Then, s)
+			if b.Else != nil {
+				checkSymbols(b.Else, s)
+			}
+		case *RepBlock:
+			checkSymbols(b.Body, s)
+		case *ForBlock:
+			checkSymbols(b.Body, s)
+		}
+	}
+}
+
+func (s *AssemblyState) checkSymbol(name string, loc *psec.Loc) {
+	if lr, ok := s.labels[name]; ok {
+		s.checks = append(s.checks, &Diagnostic{
+			Loc:      loc,
+			Severity: SeverityWarning,
+			Message: fmt.Sprintf("Symbol '%s' is hidden by the label defined at %s:%d",
+				name, lr.loc.Filename, lr.loc.Line),
+		})
+	}
+}
+
+func copyLocs(locs map[string]*psec.Loc) map[string]*psec.Loc {
+	if locs == nil {
+		return nil
+	}
+	c := make(map[string]*psec.Loc, len(locs))
+	for k, v := range locs {
+		c[k] = v
+	}
+	return c
+}
+
+// mergeLocs adds the labels from a branch of an .if that aren't in locs.
+func mergeLocs(locs, branch map[string]*psec.Loc) {
+	for k, v := range branch {
+		if _, ok := locs[k]; !ok {
+			locs[k] = v
+		}
+	}
+}
+
+func assemble(ctx context.Context, ast *AST, s *AssemblyState) error {
 	// Now actually assemble everything.
 	s.dirty = true
 	passes := 0
 	for s.dirty || !s.resolved {
-		s.reset()
-		for _, l := range ast.Lines {
-			l.Assemble(s)
+		if err := ctx.Err(); err != nil {
+			return err
 		}
+		s.reset()
+		ast.Assemble(s)
+		s.endSizes()
 		passes++
 		if passes > 100 {
-			fmt.Printf("Attempted 100 passes but the assembly won't settle\n")
-			fmt.Printf("Dirty labels %v\n", s.dirtyLabels)
-			os.Exit(1)
+			s.Errorf(nil, "Attempted 100 passes but the assembly won't settle; dirty labels %v",
+				s.dirtyLabels)
+			return nil
 		}
 	}
 	return nil
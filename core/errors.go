@@ -2,14 +2,92 @@ package core
 
 import (
 	"fmt"
-	"os"
+	"regexp"
+	"strconv"
 
 	"github.com/shepheb/psec"
 )
 
-// AsmError is a helper for printing an error message, with code location.
-// It wraps Printf, allowing arbitrary arguments.
-func AsmError(loc *psec.Loc, msg string, args ...interface{}) {
-	fmt.Printf("Assembly error at "+loc.String()+": "+msg+"\n", args...)
-	os.Exit(1)
+// Severity distinguishes fatal errors from warnings in a Diagnostic.
+type Severity int
+
+// Severity values
+const (
+	SeverityWarning Severity = iota
+	SeverityError
+)
+
+func (sev Severity) String() string {
+	if sev == SeverityWarning {
+		return "warning"
+	}
+	return "error"
+}
+
+// Diagnostic is a single error or warning reported during assembly, with the
+// code location it refers to. Loc may be nil for problems that aren't tied to
+// one line, like an assembly that never settles.
+type Diagnostic struct {
+	Loc      *psec.Loc
+	Severity Severity
+	Message  string
+}
+
+func (d *Diagnostic) Error() string {
+	if d.Loc == nil {
+		return fmt.Sprintf("Assembly %s: %s", d.Severity, d.Message)
+	}
+	return fmt.Sprintf("Assembly %s at %s: %s", d.Severity, d.Loc.String(), d.Message)
+}
+
+// Diagnostics is the list of errors and warnings from an assembly, in the order
+// they were reported.
+type Diagnostics []*Diagnostic
+
+// HasErrors is true if any of the diagnostics is an error, rather than just a
+// warning.
+func (ds Diagnostics) HasErrors() bool {
+	for _, d := range ds {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// Errorf records an error at the given location. It wraps Sprintf, allowing
+// arbitrary arguments. Assembly carries on afterward, so one bad line doesn't
+// hide the problems on the rest.
+func (s *AssemblyState) Errorf(loc *psec.Loc, msg string, args ...interface{}) {
+	s.report(loc, SeverityError, msg, args...)
+}
+
+// Warnf records a warning at the given location, like Errorf.
+func (s *AssemblyState) Warnf(loc *psec.Loc, msg string, args ...interface{}) {
+	s.report(loc, SeverityWarning, msg, args...)
+}
+
+func (s *AssemblyState) report(loc *psec.Loc, sev Severity, msg string, args ...interface{}) {
+	s.diags = append(s.diags, &Diagnostic{
+		Loc:      loc,
+		Severity: sev,
+		Message:  fmt.Sprintf(msg, args...),
+	})
+}
+
+// parseErrorPattern matches the position psec puts at the start of a parse
+// error, as Loc.String gives it.
+var parseErrorPattern = regexp.MustCompile(`(?s)^(.+?) line (\d+) col (\d+): (.*)$`)
+
+// parseDiagnostic turns a parse error into a Diagnostic, with the position the
+// parser gave up at as its Loc. Other errors, like a missing file, have no Loc.
+func parseDiagnostic(err error) *Diagnostic {
+	d := &Diagnostic{Severity: SeverityError, Message: err.Error()}
+	if m := parseErrorPattern.FindStringSubmatch(d.Message); m != nil {
+		line, _ := strconv.Atoi(m[2])
+		col, _ := strconv.Atoi(m[3])
+		d.Loc = &psec.Loc{Filename: m[1], Line: line, Col: col}
+		d.Message = m[4]
+	}
+	return d
 }
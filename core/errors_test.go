@@ -0,0 +1,45 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseErrorLocation(t *testing.T) {
+	a := NewAssembler(newTestDriver, Options{})
+	_, err := a.Assemble(context.Background(),
+		Source{Filename: "test", Text: []byte(".dat 1\n.dat 2 ]\n.dat 3\n")})
+	diags, ok := err.(Diagnostics)
+	if !ok || len(diags) != 1 || diags[0].Loc == nil ||
+		diags[0].Loc.Filename != "test" || diags[0].Loc.Line != 2 {
+		t.Fatalf("expected a parse error on test line 2, got %v", err)
+	}
+	if strings.Contains(diags[0].Message, "line 2") {
+		t.Errorf("expected the location to be out of the message, got %q", diags[0].Message)
+	}
+
+	// In an included file, it's where that file failed to parse.
+	dir, err := ioutil.TempDir("", "drasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"main.asm": ".dat 0\n.include \"bad.inc\"\n",
+		"bad.inc":  ".dat 1\n\n.dat 2 ]\n",
+	})
+	res, _ := NewAssembler(newTestDriver, Options{}).Assemble(context.Background(),
+		Source{Filename: filepath.Join(dir, "main.asm")})
+	if res == nil || len(res.Diagnostics) != 1 {
+		t.Fatalf("expected one error, got %v", res)
+	}
+	d := res.Diagnostics[0]
+	if d.Loc.Line != 3 || !strings.HasSuffix(d.Loc.Filename, "bad.inc") ||
+		!strings.HasSuffix(d.Message, ", included from "+filepath.Join(dir, "main.asm")+":2") {
+		t.Errorf("expected an error at bad.inc:3, included from main.asm:2, got %q at %v", d.Message, d.Loc)
+	}
+}
@@ -0,0 +1,66 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+)
+
+// simpleEscapes are the one-character backslash escapes in string and
+// character literals.
+var simpleEscapes = map[byte]rune{
+	'n':  '\n',
+	'r':  '\r',
+	't':  '\t',
+	'0':  0,
+	'e':  0x1b,
+	'\\': '\\',
+	'\'': '\'',
+	'"':  '"',
+}
+
+// Unescape decodes the text of a string or character literal, without its
+// quotes, into characters. Besides simpleEscapes, \xHH and \uHHHH give a
+// character by its code. It's exported for drivers whose string directives add
+// escapes of their own.
+func Unescape(text string) ([]rune, error) {
+	var chars []rune
+	for i := 0; i < len(text); {
+		if text[i] != '\\' {
+			r, size := utf8.DecodeRuneInString(text[i:])
+			chars = append(chars, r)
+			i += size
+			continue
+		}
+
+		if i+1 >= len(text) {
+			return nil, fmt.Errorf("unfinished escape at the end of %q", text)
+		}
+		c := text[i+1]
+		if r, ok := simpleEscapes[c]; ok {
+			chars = append(chars, r)
+			i += 2
+			continue
+		}
+
+		digits := 0
+		switch c {
+		case 'x':
+			digits = 2
+		case 'u':
+			digits = 4
+		default:
+			return nil, fmt.Errorf("unknown escape \\%c", c)
+		}
+		if i+2+digits > len(text) {
+			return nil, fmt.Errorf("\\%c needs %d hex digits", c, digits)
+		}
+		code, err := strconv.ParseUint(text[i+2:i+2+digits], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("\\%c needs %d hex digits", c, digits)
+		}
+		chars = append(chars, rune(code))
+		i += 2 + digits
+	}
+	return chars, nil
+}
@@ -3,6 +3,7 @@ package core
 import (
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/shepheb/psec"
 )
@@ -23,7 +24,7 @@ func ws() psec.Parser {
 
 func addExprParsers(g *psec.Grammar) {
 	// Expressions
-	g.WithAction("unaryOp", psec.OneOf("+-~"),
+	g.WithAction("unaryOp", psec.OneOf("+-~!"),
 		func(r interface{}, loc *psec.Loc) (interface{}, error) {
 			return OperatorNames[string((r.(byte)))], nil
 		})
@@ -32,7 +33,7 @@ func addExprParsers(g *psec.Grammar) {
 			return OperatorNames[string((r.(byte)))], nil
 		})
 	g.WithAction("mulOp",
-		psec.Alt(psec.OneOf("*/&"), lit("<<"), lit(">>")),
+		psec.Alt(psec.OneOf("*/%&"), lit("<<"), lit(">>")),
 		func(r interface{}, loc *psec.Loc) (interface{}, error) {
 			switch rr := r.(type) {
 			case string:
@@ -46,7 +47,53 @@ func addExprParsers(g *psec.Grammar) {
 			return nil, fmt.Errorf("can't happen: unrecognized mulOp %v", r)
 		})
 
+	// Comparisons and logic, which are looser than everything else, as in C.
+	// The older operators keep their own precedence above: | and ^ with + and -,
+	// and & and the shifts with * and /.
+	stringOp := func(r interface{}, loc *psec.Loc) (interface{}, error) {
+		return OperatorNames[strings.ToLower(r.(string))], nil
+	}
+	g.WithAction("orOp", lit("||"), stringOp)
+	g.WithAction("andOp", lit("&&"), stringOp)
+	g.WithAction("eqOp", psec.Alt(lit("=="), lit("!=")), stringOp)
+	// Signed comparisons are words, and need spaces: a slt b
+	g.WithAction("relOp",
+		psec.Alt(lit("<="), lit(">="), lit("<"), lit(">"),
+			psec.SeqAt(0, psec.Alt(litIC("slt"), litIC("sle"), litIC("sgt"), litIC("sge")),
+				sym("ws1"))),
+		stringOp)
+
 	g.WithAction("expr",
+		psec.Seq(sym("expr or"), psec.Optional(psec.Seq(ws(), lit("?"), ws(), sym("expr"),
+			ws(), lit(":"), ws(), sym("expr")))),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			rs := r.([]interface{})
+			if rs[1] == nil {
+				return rs[0], nil
+			}
+			branches := rs[1].([]interface{})
+			return Ternary(rs[0].(Expression), branches[3].(Expression),
+				branches[7].(Expression)), nil
+		})
+
+	g.WithAction("expr or",
+		psec.Seq(sym("expr and"),
+			psec.Many(psec.Seq(ws(), sym("orOp"), ws(), sym("expr and")))),
+		binaryAction)
+	g.WithAction("expr and",
+		psec.Seq(sym("expr eq"),
+			psec.Many(psec.Seq(ws(), sym("andOp"), ws(), sym("expr eq")))),
+		binaryAction)
+	g.WithAction("expr eq",
+		psec.Seq(sym("expr rel"),
+			psec.Many(psec.Seq(ws(), sym("eqOp"), ws(), sym("expr rel")))),
+		binaryAction)
+	g.WithAction("expr rel",
+		psec.Seq(sym("expr0"),
+			psec.Many(psec.Seq(ws(), sym("relOp"), ws(), sym("expr0")))),
+		binaryAction)
+
+	g.WithAction("expr0",
 		psec.Seq(sym("expr1"),
 			psec.Many(psec.Seq(ws(), sym("addOp"), ws(), sym("expr1")))),
 		binaryAction)
@@ -56,56 +103,115 @@ func addExprParsers(g *psec.Grammar) {
 			psec.Many(psec.Seq(ws(), sym("mulOp"), ws(), sym("expr2")))),
 		binaryAction)
 
+	// Unary operators can be repeated, as in !!x.
 	g.WithAction("expr2",
-		psec.Seq(psec.Optional(psec.SeqAt(0, sym("unaryOp"), ws())), sym("expr3")),
+		psec.Alt(psec.Seq(sym("unaryOp"), ws(), sym("expr2")), sym("expr3")),
 		func(r interface{}, loc *psec.Loc) (interface{}, error) {
-			rs := r.([]interface{})
-			if rs[0] == nil {
-				return rs[1], nil
+			rs, ok := r.([]interface{})
+			if !ok {
+				return r, nil
 			}
 
-			return Unary(rs[0].(Operator), rs[1].(Expression)), nil
+			return Unary(rs[0].(Operator), rs[2].(Expression)), nil
 		})
 
-	g.AddSymbol("expr3", psec.Alt(sym("label_use"), sym("literal"),
+	g.AddSymbol("expr3", psec.Alt(sym("call"), sym("label_use"), sym("prefixed literal"),
+		sym("numeric label use"), sym("decimal literal"),
 		psec.SeqAt(2, lit("("), ws(), sym("expr"), ws(), lit(")"))))
 
-	g.WithAction("label_use", sym("identifier"),
+	// Function names aren't identifiers, so they can be reserved words.
+	g.AddSymbol("function name", psec.Stringify(psec.Seq(sym("identifier start"),
+		psec.Many(psec.Alt(psec.Range('0', '9'), sym("letterish"))))))
+	g.WithAction("call",
+		psec.Seq(sym("function name"), ws(), lit("("), ws(),
+			psec.Optional(psec.SepBy(sym("expr"), psec.Seq(ws(), lit(","), ws()))),
+			ws(), lit(")")),
 		func(r interface{}, loc *psec.Loc) (interface{}, error) {
-			return UseLabel(r.(string), loc), nil
+			rs := r.([]interface{})
+			var args []Expression
+			if rawArgs, ok := rs[4].([]interface{}); ok {
+				for _, arg := range rawArgs {
+					args = append(args, arg.(Expression))
+				}
+			}
+			return Call(rs[0].(string), args, loc), nil
 		})
 
-	// TODO: hex and binary literals, maybe character literals?
-	g.WithAction("hex literal",
-		psec.SeqAt(1, litIC("0x"), psec.Stringify(psec.Many1(sym("hex digit")))),
+	// A global label, a local one (.name) or a local one in full (global.name).
+	g.WithAction("label_use",
+		psec.Alt(psec.Seq(sym("identifier"), psec.Optional(sym("local label"))),
+			sym("local label")),
 		func(r interface{}, loc *psec.Loc) (interface{}, error) {
-			i, err := strconv.ParseInt(r.(string), 16, 64)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse integer literal '%s': %v", r, err)
-			}
-
-			if i > 0xffffffff {
-				return nil, fmt.Errorf("numeric literal %x is too big for 32-bit value", i)
+			if rs, ok := r.([]interface{}); ok {
+				if local, ok := rs[1].(string); ok {
+					return UseLabel(rs[0].(string)+local, loc), nil
+				}
+				return UseLabel(rs[0].(string), loc), nil
 			}
-			return &Constant{Value: uint32(i), Loc: loc}, nil
+			return UseLabel(r.(string), loc), nil
+		})
+	g.WithAction("numeric label use", psec.Seq(sym("numeric label"), psec.OneOf("fb")),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			rs := r.([]interface{})
+			return &NumericLabelUse{label: rs[0].(string), forward: rs[1].(byte) == 'f', loc: loc}, nil
 		})
+
+	// Numbers can have _ between digits, like 0b1010_1100.
 	g.AddSymbol("hex digit", psec.Alt(psec.Range('0', '9'), psec.Range('a', 'f'),
 		psec.Range('A', 'F')))
-
-	g.WithAction("decimal literal", psec.Stringify(psec.Many1(psec.Range('0', '9'))),
+	digits := func(digit psec.Parser) psec.Parser {
+		return psec.Stringify(psec.Seq(digit, psec.Many(psec.Alt(digit, lit("_")))))
+	}
+	g.WithAction("hex literal",
+		psec.SeqAt(1, psec.Alt(litIC("0x"), lit("$")), digits(sym("hex digit"))),
+		numberAction(16))
+	g.WithAction("binary literal",
+		psec.SeqAt(1, litIC("0b"), digits(psec.OneOf("01"))),
+		numberAction(2))
+	g.WithAction("octal literal",
+		psec.SeqAt(1, litIC("0o"), digits(psec.Range('0', '7'))),
+		numberAction(8))
+	g.WithAction("decimal literal", digits(psec.Range('0', '9')), numberAction(10))
+
+	// 'A', or an escape like '\n'. The quotes can hold anything but a newline,
+	// so the error for eg. 'ab' is a useful one.
+	g.WithAction("char literal",
+		psec.SeqAt(1, lit("'"),
+			psec.Stringify(psec.Many1(psec.Alt(psec.Seq(lit("\\"), psec.NoneOf("\n")),
+				psec.NoneOf("'\\\n")))),
+			lit("'")),
 		func(r interface{}, loc *psec.Loc) (interface{}, error) {
-			i, err := strconv.ParseInt(r.(string), 10, 64)
+			chars, err := Unescape(r.(string))
 			if err != nil {
-				return nil, fmt.Errorf("failed to parse integer literal '%s': %v", r, err)
+				return nil, err
 			}
-
-			if i > 0xffffffff {
-				return nil, fmt.Errorf("numeric literal %d is too big for 32-bit value", i)
+			if len(chars) != 1 {
+				return nil, fmt.Errorf("character literal '%s' must be a single character", r)
 			}
-			return &Constant{Value: uint32(i), Loc: loc}, nil
+			return &Char{Value: chars[0], Loc: loc}, nil
 		})
 
-	g.AddSymbol("literal", psec.Alt(sym("hex literal"), sym("decimal literal")))
+	// The literals with a prefix, which need to come before numeric label uses
+	// like 0b in expr3.
+	g.AddSymbol("prefixed literal", psec.Alt(sym("hex literal"), sym("binary literal"),
+		sym("octal literal"), sym("char literal")))
+	g.AddSymbol("literal", psec.Alt(sym("prefixed literal"), sym("decimal literal")))
+}
+
+// numberAction parses the digits of a numeric literal in the given base.
+func numberAction(base int) func(r interface{}, loc *psec.Loc) (interface{}, error) {
+	return func(r interface{}, loc *psec.Loc) (interface{}, error) {
+		digits := strings.ReplaceAll(r.(string), "_", "")
+		i, err := strconv.ParseUint(digits, base, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse integer literal '%s': %v", r, err)
+		}
+
+		if i > 0xffffffff {
+			return nil, fmt.Errorf("numeric literal '%s' is too big for 32-bit value", r)
+		}
+		return &Constant{Value: uint32(i), Loc: loc}, nil
+	}
 }
 
 func binaryAction(r interface{}, loc *psec.Loc) (interface{}, error) {
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"context"
+	"testing"
+)
+
+func TestComparisonOperators(t *testing.T) {
+	_, res := assembleTest(t, `
+.dat 1 == 1, 1 != 1, 2 < 3, 3 <= 3, 2 > 3, 3 >= 4
+.dat -1 > 0, -1 sgt 0, -1 slt 0, 2 SLE 2, -5 sge -4
+.dat 17 % 5, 2 + 3 == 5, 1 < 2 == 1`)
+	expectWords(t, res,
+		1, 0, 1, 1, 0, 0,
+		1, 0, 1, 1, 0,
+		2, 1, 1)
+}
+
+func TestLogicalOperators(t *testing.T) {
+	_, res := assembleTest(t, `
+.dat 3 && 4, 3 && 0, 0 || 7, 0 || 0, !0, !9, !!9
+.dat 1 || 0 && 0, 0 == 0 && 2 > 1
+.dat defined(nope) && nope, defined(nope) || 5`)
+	// && binds tighter than ||, and the undefined label is never evaluated.
+	expectWords(t, res,
+		1, 0, 1, 0, 1, 0, 1,
+		1, 1,
+		0, 1)
+}
+
+func TestTernary(t *testing.T) {
+	_, res := assembleTest(t, `
+.def flag, 1
+.dat flag ? 3 : 5, !flag ? 3 : 5
+.dat 0 ? 1 : 0 ? 2 : 3, (flag ? 10 : 20) + 1
+.dat flag ? 7 : undefined_label`)
+	expectWords(t, res, 3, 5, 3, 11, 7)
+}
+
+func TestOldPrecedence(t *testing.T) {
+	// The original operators keep their precedence: | with +, & with *.
+	_, res := assembleTest(t, `.dat 1 | 2 + 4, 6 & 3 * 2, 1 << 2 + 1`)
+	expectWords(t, res, 7, 4, 5)
+}
+
+func TestDivisionByZero(t *testing.T) {
+	_, res := assembleTest(t, ".def zero, 0\n.dat 1 / zero\n.dat 7 % (3 - 3)")
+	ds := res.Diagnostics
+	if len(ds) != 2 || ds[0].Message != "division by zero" || ds[0].Loc.Line != 2 ||
+		ds[1].Message != "division by zero" || ds[1].Loc.Line != 3 {
+		t.Errorf("expected two division by zero errors, got %v", ds)
+	}
+}
+
+func TestLiterals(t *testing.T) {
+	_, res := assembleTest(t, `
+.dat 0b1010_1100, 0B11, 0o17, 0O7_7, $FF, $dead_beef >> 16, 0x12_34, 1_000
+.dat 'A', ' ', '\n', '\'', '\\', '\x7f', 'é', 'é', ';'`)
+	expectWords(t, res,
+		0xac, 3, 15, 63, 0xff, 0xdead, 0x1234, 1000,
+		'A', ' ', '\n', '\'', '\\', 0x7f, 0xe9, 0xe9, ';')
+}
+
+func TestLiteralsAndLabels(t *testing.T) {
+	// 0b and 1b can be numeric labels, when they aren't binary literals.
+	_, res := assembleTest(t, `
+:0 .dat 0b, 0b1
+:1 .dat 1b
+:x$y .dat x$y`)
+	expectWords(t, res, 0, 1, 2, 3)
+}
+
+func TestBadLiterals(t *testing.T) {
+	for _, src := range []string{
+		".dat 'ab'",
+		".dat ''",
+		".dat '\\q'",
+		".dat 0x1_0000_0000",
+		".dat 0b102",
+		".def $x, 1",
+	} {
+		a := NewAssembler(newTestDriver, Options{})
+		if _, err := a.Assemble(context.Background(), Source{Filename: "test", Text: []byte(src)}); err == nil {
+			t.Errorf("%s: expected an error", src)
+		}
+	}
+}
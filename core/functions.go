@@ -0,0 +1,166 @@
+package core
+
+import "github.com/shepheb/psec"
+
+// Function is a function that can be called in expressions, like hi(x). It
+// gets its arguments unevaluated, so it can treat them as names, as defined()
+// does, or skip evaluating them. Errors should be reported with s.Errorf at loc,
+// returning any value.
+type Function func(s *AssemblyState, loc *psec.Loc, args []Expression) uint32
+
+// CallExpr is a function call in an expression.
+type CallExpr struct {
+	name string
+	args []Expression
+	loc  *psec.Loc
+}
+
+// Call constructs a CallExpr AST node.
+func Call(name string, args []Expression, loc *psec.Loc) *CallExpr {
+	return &CallExpr{name, args, loc}
+}
+
+// Evaluate for CallExpr looks up the function and calls it.
+func (c *CallExpr) Evaluate(s *AssemblyState) uint32 {
+	fn, ok := s.asm.functions[c.name]
+	if !ok {
+		s.Errorf(c.loc, "Unknown function '%s'", c.name)
+		return 0
+	}
+	return fn(s, c.loc, c.args)
+}
+
+// Location for CallExpr
+func (c *CallExpr) Location() *psec.Loc { return c.loc }
+
+// Equals for CallExpr
+func (c *CallExpr) Equals(expr Expression) bool {
+	c2, ok := expr.(*CallExpr)
+	if !ok || c.name != c2.name || len(c.args) != len(c2.args) {
+		return false
+	}
+	for i, arg := range c.args {
+		if !arg.Equals(c2.args[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// AddFunction makes a function callable in expressions, replacing any built-in
+// with the same name. Machine drivers can call this to add their own.
+func (a *Assembler) AddFunction(name string, fn Function) {
+	a.functions[name] = fn
+}
+
+// builtinFunctions are the functions every Assembler starts with.
+func builtinFunctions() map[string]Function {
+	return map[string]Function{
+		"hi": unaryFunction(func(x uint32) uint32 { return x >> 16 }),
+		"lo": unaryFunction(func(x uint32) uint32 { return x & 0xffff }),
+		"abs": unaryFunction(func(x uint32) uint32 {
+			if int32(x) < 0 {
+				return -x
+			}
+			return x
+		}),
+		"min":     fnMin,
+		"max":     fnMax,
+		"align":   fnAlign,
+		"defined": fnDefined,
+		"sizeof":  fnSizeof,
+	}
+}
+
+// checkArgs reports an error unless there are exactly n arguments.
+func checkArgs(s *AssemblyState, loc *psec.Loc, args []Expression, n int) bool {
+	if len(args) != n {
+		s.Errorf(loc, "expected %d arguments, got %d", n, len(args))
+		return false
+	}
+	return true
+}
+
+func unaryFunction(f func(x uint32) uint32) Function {
+	return func(s *AssemblyState, loc *psec.Loc, args []Expression) uint32 {
+		if !checkArgs(s, loc, args, 1) {
+			return 0
+		}
+		return f(args[0].Evaluate(s))
+	}
+}
+
+// min and max compare as signed numbers, and take any number of arguments.
+func fnMin(s *AssemblyState, loc *psec.Loc, args []Expression) uint32 {
+	return fold(s, loc, args, func(a, b int32) bool { return b < a })
+}
+
+func fnMax(s *AssemblyState, loc *psec.Loc, args []Expression) uint32 {
+	return fold(s, loc, args, func(a, b int32) bool { return b > a })
+}
+
+func fold(s *AssemblyState, loc *psec.Loc, args []Expression, better func(a, b int32) bool) uint32 {
+	if len(args) == 0 {
+		s.Errorf(loc, "expected at least 1 argument")
+		return 0
+	}
+	best := int32(args[0].Evaluate(s))
+	for _, arg := range args[1:] {
+		if x := int32(arg.Evaluate(s)); better(best, x) {
+			best = x
+		}
+	}
+	return uint32(best)
+}
+
+// align(x, n) rounds x up to a multiple of n.
+func fnAlign(s *AssemblyState, loc *psec.Loc, args []Expression) uint32 {
+	if !checkArgs(s, loc, args, 2) {
+		return 0
+	}
+	x := args[0].Evaluate(s)
+	n := args[1].Evaluate(s)
+	if n == 0 {
+		s.Errorf(args[1].Location(), "can't align to 0")
+		return x
+	}
+	return (x + n - 1) / n * n
+}
+
+// labelArg gets the name from a function argument that should be a label.
+func labelArg(s *AssemblyState, loc *psec.Loc, args []Expression) (string, bool) {
+	if !checkArgs(s, loc, args, 1) {
+		return "", false
+	}
+	l, ok := args[0].(*LabelUse)
+	if !ok {
+		s.Errorf(args[0].Location(), "expected a label or symbol name")
+		return "", false
+	}
+	return l.label, true
+}
+
+// defined(name) is 1 if the label or symbol has been defined so far this pass,
+// 0 if not.
+func fnDefined(s *AssemblyState, loc *psec.Loc, args []Expression) uint32 {
+	name, ok := labelArg(s, loc, args)
+	if !ok {
+		return 0
+	}
+	return boolValue(s.isDefined(name))
+}
+
+// sizeof(label) is the number of words from the label to the next label at its
+// level, or to the end of its data.
+func fnSizeof(s *AssemblyState, loc *psec.Loc, args []Expression) uint32 {
+	name, ok := labelArg(s, loc, args)
+	if !ok {
+		return 0
+	}
+	lr, ok := s.labels[s.labelKey(name)]
+	if !ok {
+		s.Errorf(loc, "Unknown label '%s'", s.qualify(name))
+		return 0
+	}
+	return lr.size
+}
@@ -0,0 +1,70 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/shepheb/psec"
+)
+
+func TestBuiltinFunctions(t *testing.T) {
+	_, res := assembleTest(t, `
+.def addr, 0x12345678
+.dat hi(addr), lo(addr), hi (0x10000) + 1
+.dat min(5, -2, 3), max(5, -2, 3), min(7), abs(-4), abs(4)
+.dat align(5, 4), align(8, 4), align(0, 16), align(7, 3)
+.dat defined(addr), defined(nope), defined(later)
+:later`)
+	expectWords(t, res,
+		0x1234, 0x5678, 2,
+		0xfffe, 5, 7, 4, 4,
+		8, 8, 0, 9,
+		1, 0, 0)
+}
+
+func TestSizeof(t *testing.T) {
+	_, res := assembleTest(t, `
+.dat sizeof(msg), sizeof(table), sizeof(table.second), sizeof(empty), sizeof(tail)
+:msg .dat "hello"
+:table
+:.first .dat 1, 2
+:.second .dat 3, 4, 5
+:1 .dat 6
+:empty
+.org 0x11
+:tail .dat 7, 8`)
+	// Numeric labels don't split a size; .org and the end of the file end one.
+	expectWords(t, res, 5, 6, 4, 0, 2,
+		'h', 'e', 'l', 'l', 'o', 1, 2, 3, 4, 5, 6, 0, 7, 8)
+}
+
+func TestFunctionErrors(t *testing.T) {
+	cases := map[string]string{
+		".dat hi(1, 2)":    "expected 1 arguments, got 2",
+		".dat min()":       "expected at least 1 argument",
+		".dat align(3, 0)": "can't align to 0",
+		".dat sizeof(1)":   "expected a label or symbol name",
+		".dat nope(1)":     "Unknown function 'nope'",
+	}
+	for src, msg := range cases {
+		_, res := assembleTest(t, src)
+		if len(res.Diagnostics) != 1 || res.Diagnostics[0].Message != msg {
+			t.Errorf("%s: expected %q, got %v", src, msg, res.Diagnostics)
+		}
+	}
+}
+
+func TestAddFunction(t *testing.T) {
+	a := NewAssembler(newTestDriver, Options{})
+	a.AddFunction("twice", func(s *AssemblyState, loc *psec.Loc, args []Expression) uint32 {
+		if !checkArgs(s, loc, args, 1) {
+			return 0
+		}
+		return 2 * args[0].Evaluate(s)
+	})
+	res, err := a.Assemble(context.Background(), Source{Filename: "test", Text: []byte(".dat twice(21)")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectWords(t, res, 42)
+}
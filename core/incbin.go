@@ -0,0 +1,120 @@
+package core
+
+import (
+	"io/ioutil"
+
+	"github.com/shepheb/psec"
+)
+
+// packing is how .incbin packs a file's bytes into words.
+type packing int
+
+const (
+	packBigEndian    packing = iota // .incbin: the first byte is the high one.
+	packLittleEndian                // .incbin_le: the first byte is the low one.
+	packBytes                       // .incbin_byte: each byte is a word.
+)
+
+// IncBin writes the contents of a binary file, or a slice of it, into the
+// output: .incbin "file"[, offset[, length]]
+// The offset and length count bytes, and the length defaults to the rest of the
+// file. With two bytes per word, an odd byte out is padded with a 0 byte.
+type IncBin struct {
+	Path    string
+	Packing packing
+	Offset  Expression // nil for 0
+	Length  Expression // nil for the rest of the file
+	loc     *psec.Loc
+
+	// The file is read on the first pass, and kept for the rest.
+	data   []byte
+	err    error
+	loaded bool
+}
+
+// Assemble for IncBin writes the words on every pass, so they count towards the
+// addresses of the labels after it.
+func (b *IncBin) Assemble(s *AssemblyState) {
+	if !b.loaded {
+		b.data, b.err = ioutil.ReadFile(b.Path)
+		b.loaded = true
+	}
+	if b.err != nil {
+		s.Errorf(b.loc, "can't read .incbin file: %v", b.err)
+		return
+	}
+
+	size := uint32(len(b.data))
+	offset := uint32(0)
+	if b.Offset != nil {
+		offset = b.Offset.Evaluate(s)
+	}
+	if offset > size {
+		s.Errorf(b.loc, ".incbin offset %d is past the end of %s, which is %d bytes",
+			offset, b.Path, size)
+		return
+	}
+	length := size - offset
+	if b.Length != nil {
+		length = b.Length.Evaluate(s)
+		if length > size-offset {
+			s.Errorf(b.loc, ".incbin of %d bytes at offset %d is past the end of %s, which is %d bytes",
+				length, offset, b.Path, size)
+			return
+		}
+	}
+
+	data := b.data[offset : offset+length]
+	if b.Packing == packBytes {
+		for _, x := range data {
+			s.Push(uint16(x))
+		}
+		return
+	}
+	for i := 0; i < len(data); i += 2 {
+		first, second := uint16(data[i]), uint16(0)
+		if i+1 < len(data) {
+			second = uint16(data[i+1])
+		}
+		if b.Packing == packBigEndian {
+			s.Push(first<<8 | second)
+		} else {
+			s.Push(second<<8 | first)
+		}
+	}
+}
+
+func addIncBinParsers(g *psec.Grammar) {
+	argSep := psec.Seq(ws(), lit(","), ws())
+	packings := []struct {
+		name    string
+		packing packing
+	}{
+		// The longer names must come before their prefix, incbin.
+		{"incbin_le", packLittleEndian},
+		{"incbin_byte", packBytes},
+		{"incbin", packBigEndian},
+	}
+	var dirs []psec.Parser
+	for _, p := range packings {
+		packing := p.packing
+		name := "dir:" + p.name
+		g.WithAction(name,
+			psec.Seq(litIC(p.name), sym("ws1"), sym("path"),
+				psec.Optional(psec.Seq(argSep, sym("expr"),
+					psec.Optional(psec.SeqAt(1, argSep, sym("expr")))))),
+			func(r interface{}, loc *psec.Loc) (interface{}, error) {
+				rs := r.([]interface{})
+				b := &IncBin{Path: relativePath(loc, rs[2].(string)), Packing: packing, loc: loc}
+				if args, ok := rs[3].([]interface{}); ok {
+					b.Offset = args[1].(Expression)
+					if length, ok := args[2].(Expression); ok {
+						b.Length = length
+					}
+				}
+				return b, nil
+			})
+		dirs = append(dirs, sym(name))
+	}
+	g.AddSymbol("dir:incbins", psec.Alt(dirs...))
+}
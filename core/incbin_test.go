@@ -0,0 +1,67 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIncBin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	blob := []byte{0x12, 0x34, 0x56, 0x78, 0x9a}
+	if err := ioutil.WriteFile(filepath.Join(dir, "data", "blob.bin"), blob, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The path is relative to the source file, and the label after it moves
+	// with its size.
+	src := `
+.dat end
+.incbin "data/blob.bin"
+.incbin_le "data/blob.bin", 1, 2
+.incbin_byte "data/blob.bin", 3
+:end`
+	a := NewAssembler(newTestDriver, Options{})
+	res, err := a.Assemble(context.Background(),
+		Source{Filename: filepath.Join(dir, "main.asm"), Text: []byte(src)})
+	if res == nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectWords(t, res, 7, 0x1234, 0x5678, 0x9a00, 0x5634, 0x78, 0x9a)
+
+	// Paths have no escapes, so a backslash is taken as it is. On Windows it's a
+	// separator, and elsewhere it's part of the name.
+	if err := ioutil.WriteFile(filepath.Join(dir, `lib\font.bin`), blob[:2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	res, err = NewAssembler(newTestDriver, Options{}).Assemble(context.Background(),
+		Source{Filename: filepath.Join(dir, "main.asm"), Text: []byte(`.incbin "lib\font.bin"`)})
+	if res == nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectWords(t, res, 0x1234)
+
+	for _, c := range []struct{ src, msg string }{
+		{`.incbin "missing.bin"`, "can't read .incbin file"},
+		{`.incbin "data/blob.bin", 6`, "offset 6 is past the end"},
+		{`.incbin "data/blob.bin", 2, 4`, "of 4 bytes at offset 2 is past the end"},
+	} {
+		a := NewAssembler(newTestDriver, Options{})
+		res, _ := a.Assemble(context.Background(),
+			Source{Filename: filepath.Join(dir, "main.asm"), Text: []byte(c.src)})
+		if res == nil || len(res.Diagnostics) != 1 ||
+			!strings.Contains(res.Diagnostics[0].Message, c.msg) {
+			t.Errorf("%s: expected an error with %q, got %v", c.src, c.msg, res)
+		}
+	}
+}
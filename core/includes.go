@@ -0,0 +1,158 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/shepheb/psec"
+)
+
+// includeError is left in the AST by an .include that failed, to report it when
+// assembling, with the chain of includes that led to it.
+type includeError struct {
+	msg string
+	loc *psec.Loc
+}
+
+// Assemble for includeError reports the failure.
+func (e *includeError) Assemble(s *AssemblyState) {
+	s.Errorf(e.loc, "%s", e.msg)
+}
+
+// relativePath resolves a path in a directive relative to the file it's in.
+func relativePath(loc *psec.Loc, path string) string {
+	if filepath.IsAbs(path) || loc == nil {
+		return path
+	}
+	return filepath.Join(filepath.Dir(loc.Filename), path)
+}
+
+// findInclude finds an included file. .include "file" looks next to the
+// including file first, then in each of Options.IncludePaths in order, while
+// .include <file> only looks in the IncludePaths.
+func (a *Assembler) findInclude(loc *psec.Loc, name string, system bool) (string, error) {
+	if filepath.IsAbs(name) {
+		return name, nil
+	}
+
+	var candidates []string
+	if !system {
+		candidates = append(candidates, relativePath(loc, name))
+	}
+	for _, dir := range a.Options.IncludePaths {
+		candidates = append(candidates, filepath.Join(dir, name))
+	}
+	for _, path := range candidates {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path, nil
+		}
+	}
+
+	if len(a.Options.IncludePaths) == 0 {
+		return "", fmt.Errorf("can't find include file %q", name)
+	}
+	return "", fmt.Errorf("can't find include file %q in %s", name,
+		strings.Join(a.Options.IncludePaths, ", "))
+}
+
+// canonicalPath gives the absolute path of a file with any symlinks resolved,
+// to tell when two includes name the same file.
+func canonicalPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+	return path
+}
+
+// include parses an included file. It's skipped if the file has an .once
+// directive and has been parsed already, or for .include_once if it's been
+// parsed at all. If it fails, or it would include itself, the error is returned
+// as an includeError, naming the files that included this one, innermost first.
+// If it fails to parse, the error is at the place in the file it stopped.
+func (a *Assembler) include(loc *psec.Loc, name string, system, once bool) Assembled {
+	path, err := a.findInclude(loc, name, system)
+	if err == nil {
+		canonical := canonicalPath(path)
+		if a.once[canonical] || (once && a.parsed[canonical]) {
+			return &AST{}
+		}
+		if a.isIncluding(canonical, loc) {
+			err = fmt.Errorf("circular include of %s", path)
+		} else {
+			var ast *AST
+			a.including = append(a.including, loc)
+			ast, err = a.parseFile(path)
+			a.including = a.including[:len(a.including)-1]
+			if err == nil {
+				return ast
+			}
+		}
+	}
+
+	// A parse error is reported where the parser stopped, in the included file.
+	msg := err.Error()
+	if d := parseDiagnostic(err); d.Loc != nil {
+		msg = fmt.Sprintf("%s, included from %s:%d", d.Message, loc.Filename, loc.Line)
+		loc = d.Loc
+	}
+	for i := len(a.including) - 1; i >= 0; i-- {
+		msg += fmt.Sprintf(", included from %s:%d", a.including[i].Filename, a.including[i].Line)
+	}
+	return &includeError{msg: msg, loc: loc}
+}
+
+func copyFlags(flags map[string]bool) map[string]bool {
+	c := make(map[string]bool, len(flags))
+	for k, v := range flags {
+		c[k] = v
+	}
+	return c
+}
+
+// isIncluding is true if the file is already being parsed, as the one with the
+// .include at loc or one of the files that included it.
+func (a *Assembler) isIncluding(canonical string, loc *psec.Loc) bool {
+	if canonicalPath(loc.Filename) == canonical {
+		return true
+	}
+	for _, l := range a.including {
+		if canonicalPath(l.Filename) == canonical {
+			return true
+		}
+	}
+	return false
+}
+
+func addIncludeParsers(g *psec.Grammar, a *Assembler) {
+	// File paths in .include and .incbin are quoted like strings, but without
+	// escapes, so Windows paths like "lib\font.bin" work.
+	g.AddSymbol("path",
+		psec.SeqAt(1, lit("\""), psec.Stringify(psec.Many1(psec.NoneOf("\"\n"))), lit("\"")))
+
+	g.WithAction("dir:include",
+		psec.Seq(psec.Alt(litIC("include_once"), litIC("include")), sym("ws1"),
+			psec.Alt(sym("path"),
+				psec.Seq(lit("<"), psec.Stringify(psec.Many1(psec.NoneOf(">\n"))), lit(">")))),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			rs := r.([]interface{})
+			once := strings.EqualFold(rs[0].(string), "include_once")
+			// Recursively parse the file.
+			if name, ok := rs[2].(string); ok {
+				return a.include(loc, name, false, once), nil
+			}
+			return a.include(loc, rs[2].([]interface{})[1].(string), true, once), nil
+		})
+
+	// .once anywhere in a file means it's only parsed the first time it's
+	// included, like an include guard.
+	g.WithAction("dir:once", litIC("once"),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			a.once[canonicalPath(loc.Filename)] = true
+			return &AST{}, nil
+		})
+}
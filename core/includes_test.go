@@ -0,0 +1,155 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes files, named by paths relative to dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, text := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIncludePaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"src/main.asm":  ".include \"lib/a.asm\"\n.include \"sys.inc\"\n.include <both.inc>\n",
+		"src/lib/a.asm": ".dat 1\n.include \"b.asm\"\n",
+		"src/lib/b.asm": ".dat 2\n",
+		"src/both.inc":  ".dat 0xbad\n",
+		"sys/sys.inc":   ".dat 3\n",
+		"sys/both.inc":  ".dat 4\n",
+	})
+
+	a := NewAssembler(newTestDriver, Options{IncludePaths: []string{filepath.Join(dir, "sys")}})
+	res, err := a.Assemble(context.Background(), Source{Filename: filepath.Join(dir, "src/main.asm")})
+	if res == nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectWords(t, res, 1, 2, 3, 4)
+}
+
+func TestIncludeChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"main.asm":  ".dat 0\n.include \"lib/a.asm\"\n",
+		"lib/a.asm": ".include \"b.asm\"\n",
+		"lib/b.asm": ".dat 1\n\n.include <missing.inc>\n",
+	})
+
+	a := NewAssembler(newTestDriver, Options{IncludePaths: []string{"sys"}})
+	res, _ := a.Assemble(context.Background(), Source{Filename: filepath.Join(dir, "main.asm")})
+	if res == nil || len(res.Diagnostics) != 1 {
+		t.Fatalf("expected one error, got %v", res)
+	}
+	d := res.Diagnostics[0]
+	expected := `can't find include file "missing.inc" in sys, included from ` +
+		filepath.Join(dir, "lib/a.asm") + ":1, included from " + filepath.Join(dir, "main.asm") + ":2"
+	if d.Message != expected || d.Loc.Line != 3 || !strings.HasSuffix(d.Loc.Filename, "b.asm") {
+		t.Errorf("expected %q at b.asm:3, got %q at %v", expected, d.Message, d.Loc)
+	}
+}
+
+func TestIncludeOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"main.asm": `.include "guarded.inc"
+.include "lib/../guarded.inc"
+.include_once "plain.inc"
+.include_once "plain.inc"
+.include "plain.inc"`,
+		"guarded.inc": ".once\n:guarded .dat 1\n",
+		"plain.inc":   ".dat 2\n",
+	})
+
+	a := NewAssembler(newTestDriver, Options{})
+	res, err := a.Assemble(context.Background(), Source{Filename: filepath.Join(dir, "main.asm")})
+	if res == nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectWords(t, res, 1, 2, 2)
+}
+
+func TestIncludeOnceInMacro(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The expansion is parsed again on every pass, and must include the file
+	// each time.
+	writeFiles(t, dir, map[string]string{
+		"main.asm": `.macro m
+.include_once "lbl.inc"
+.include "guarded.inc"
+.endm
+.dat inner
+m
+m`,
+		"lbl.inc":     ":inner .dat 5\n",
+		"guarded.inc": ".once\n.dat 6\n",
+	})
+
+	a := NewAssembler(newTestDriver, Options{})
+	res, err := a.Assemble(context.Background(), Source{Filename: filepath.Join(dir, "main.asm")})
+	if res == nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectWords(t, res, 1, 5, 6)
+}
+
+func TestCircularInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"main.asm": ".include \"a.inc\"\n",
+		"a.inc":    ".dat 1\n.include \"b.inc\"\n",
+		"b.inc":    ".include \"main.asm\"\n",
+		"self.asm": ".include \"self.asm\"\n",
+	})
+
+	a := NewAssembler(newTestDriver, Options{})
+	res, _ := a.Assemble(context.Background(), Source{Filename: filepath.Join(dir, "main.asm")})
+	if res == nil || len(res.Diagnostics) != 1 {
+		t.Fatalf("expected one error, got %v", res)
+	}
+	expected := "circular include of " + filepath.Join(dir, "main.asm") +
+		", included from " + filepath.Join(dir, "a.inc") + ":2" +
+		", included from " + filepath.Join(dir, "main.asm") + ":1"
+	if res.Diagnostics[0].Message != expected {
+		t.Errorf("expected %q, got %q", expected, res.Diagnostics[0].Message)
+	}
+
+	res, _ = a.Assemble(context.Background(), Source{Filename: filepath.Join(dir, "self.asm")})
+	if res == nil || len(res.Diagnostics) != 1 ||
+		!strings.HasPrefix(res.Diagnostics[0].Message, "circular include") {
+		t.Errorf("expected a circular include error, got %v", res)
+	}
+}
@@ -0,0 +1,152 @@
+package core
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestLocalLabels(t *testing.T) {
+	_, res := assembleTest(t, `
+:first
+:.loop .dat .loop, .end
+:.end .dat first.end
+:second
+:.loop .dat .loop, first.loop, .end
+:.end`)
+	expectWords(t, res, 0, 2, 2, 3, 0, 6)
+
+	names := map[string]uint32{}
+	for _, sym := range res.Symbols {
+		names[sym.Name] = sym.Value
+	}
+	for name, value := range map[string]uint32{
+		"first": 0, "first.loop": 0, "first.end": 2,
+		"second": 3, "second.loop": 3, "second.end": 6,
+	} {
+		if v, ok := names[name]; !ok || v != value {
+			t.Errorf("expected symbol %s = %d, got %v", name, value, res.Symbols)
+		}
+	}
+}
+
+func TestLocalLabelErrors(t *testing.T) {
+	_, res := assembleTest(t, `
+:first
+:.loop .dat 1
+:second .dat .loop`)
+	if len(res.Diagnostics) != 1 ||
+		res.Diagnostics[0].Message != "Unknown label 'second.loop'" {
+		t.Errorf("expected an error for second.loop, got %v", res.Diagnostics)
+	}
+}
+
+func TestNumericLabels(t *testing.T) {
+	_, res := assembleTest(t, `
+:1 .dat 1f, 1b
+:2 .dat 1b, 2b, 2f
+:1 .dat 1b, 1f
+:2
+:1 .dat 2b`)
+	expectWords(t, res, 5, 0, 0, 2, 7, 5, 7, 7)
+
+	for _, sym := range res.Symbols {
+		if isNumericLabel(sym.Name) {
+			t.Errorf("expected no numeric labels in the symbol table, got %s", sym.Name)
+		}
+	}
+
+	_, res = assembleTest(t, ".dat 1b\n:1 .dat 2f")
+	if len(res.Diagnostics) != 2 ||
+		!strings.Contains(res.Diagnostics[0].Message, "'1b'") ||
+		!strings.Contains(res.Diagnostics[1].Message, "'2f'") {
+		t.Errorf("expected errors for 1b and 2f, got %v", res.Diagnostics)
+	}
+}
+
+func TestLocalLabelsInMacros(t *testing.T) {
+	// Numeric labels are handy in macros, since each use gets its own.
+	_, res := assembleTest(t, `
+.macro back=:1 .dat 1b
+:main back
+back
+:.end .dat .end`)
+	expectWords(t, res, 0, 1, 2)
+}
+
+func TestDuplicateLabels(t *testing.T) {
+	for _, c := range []struct{ src, msg string }{
+		{":loop .dat 1\n:loop .dat 2", "line 2 col 0: Label 'loop' is already defined at test:1"},
+		{":main\n:.loop .dat 1\n:.loop", "line 3 col 0: Label 'main.loop' is already defined at test:2"},
+		{".rep 2\n:lbl .dat 1\n.endr", "line 2 col 0: Label 'lbl' is defined more than once by the same line"},
+		{".macro m=:lbl .dat 1\nm\nm", "Label 'lbl' is already defined at test:2 (macro m):1"},
+	} {
+		_, res := assembleTest(t, c.src)
+		if len(res.Diagnostics) != 1 || !strings.Contains(res.Diagnostics[0].Error(), c.msg) {
+			t.Errorf("%q: expected an error with %q, got %v", c.src, c.msg, res.Diagnostics)
+		}
+	}
+
+	// Only one branch of an .if is assembled, so each can define the label.
+	_, res := assembleTest(t, `
+.if 1
+:lbl .dat 1
+.else
+:lbl .dat 2
+.endif
+.dat lbl`)
+	expectWords(t, res, 1, 0)
+}
+
+func TestLabelWarnings(t *testing.T) {
+	_, res := assembleTest(t, ":size .dat 1\n.define size, 4")
+	if len(res.Diagnostics) != 1 || res.Diagnostics[0].Severity != SeverityWarning ||
+		!strings.Contains(res.Diagnostics[0].Message, "Symbol 'size' is hidden by the label defined at test:1") {
+		t.Errorf("expected a warning for size, got %v", res.Diagnostics)
+	}
+
+	a := NewAssembler(newTestDriver, Options{})
+	a.SetRegisterNames("r0", "sp")
+	res, _ = a.Assemble(context.Background(), Source{Filename: "test", Text: []byte(":SP .dat 1\n:sp2")})
+	if len(res.Diagnostics) != 1 || res.Diagnostics[0].Severity != SeverityWarning ||
+		!strings.Contains(res.Diagnostics[0].Message, "Label 'SP' looks like the register sp") {
+		t.Errorf("expected a warning for SP, got %v", res.Diagnostics)
+	}
+}
+
+func TestUnderscoreLabels(t *testing.T) {
+	_, res := assembleTest(t, `
+.def _size, 5
+:first
+:_loop .dat _loop, _size
+:second
+:_loop .dat _loop, first._loop, sizeof(_loop)`)
+	expectWords(t, res, 0, 5, 2, 0, 3)
+
+	names := map[string]bool{}
+	for _, sym := range res.Symbols {
+		names[sym.Name] = true
+	}
+	if !names["first._loop"] || !names["second._loop"] {
+		t.Errorf("expected first._loop and second._loop, got %v", res.Symbols)
+	}
+
+	// One before the first global label is global, and can be used after it.
+	_, res = assembleTest(t, `
+:_start .dat 1
+:main .dat _start, sizeof(_start)`)
+	expectWords(t, res, 1, 0, 1)
+}
+
+func TestMacroLabelsKeepScope(t *testing.T) {
+	// Collecting the expansion's labels mustn't scope .end to inner before
+	// it's assembled.
+	_, res := assembleTest(t, `
+.macro m
+:.end .dat .end
+:inner .dat inner
+.endm
+:main m
+.dat main.end`)
+	expectWords(t, res, 0, 1, 0)
+}
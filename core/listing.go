@@ -0,0 +1,171 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/shepheb/psec"
+)
+
+// Emission records what one Assembled node wrote on the final pass: where it
+// came from, where its words landed, and the words themselves.
+type Emission struct {
+	Node    Assembled
+	Loc     *psec.Loc
+	Address uint32
+	Words   []uint16
+	// Lines assembled on behalf of this one: a macro's expansion, or the
+	// contents of an included file.
+	Children []*Emission
+}
+
+func (s *AssemblyState) beginLine(node Assembled, loc *psec.Loc) {
+	e := &Emission{Node: node, Loc: loc, Address: s.index}
+	if n := len(s.lineStack); n > 0 {
+		parent := s.lineStack[n-1]
+		parent.Children = append(parent.Children, e)
+	} else {
+		s.listing = append(s.listing, e)
+	}
+	s.lineStack = append(s.lineStack, e)
+}
+
+func (s *AssemblyState) endLine() {
+	n := len(s.lineStack)
+	e := s.lineStack[n-1]
+	// A line with no output of its own, like an .org, shows where it left the
+	// index. Macro uses and includes show where their expansion started.
+	if len(e.Words) == 0 && len(e.Children) == 0 {
+		e.Address = s.index
+	}
+	s.lineStack = s.lineStack[:n-1]
+}
+
+// Words per row of the listing; longer lines continue on the following rows.
+const listingWidth = 4
+
+// WriteListing writes a human-readable listing of an assembly: every source
+// line with its final address, the words it assembled to, and the file and line
+// it came from. Macro expansions and included files are indented under the line
+// that pulled them in.
+func (a *Assembler) WriteListing(w io.Writer, res *Result) error {
+	lw := &listingWriter{w: w, sources: a.sources, printed: map[string]int{}}
+	lw.lines(res.Listing, 0)
+	if len(res.Listing) > 0 {
+		if loc := res.Listing[0].Loc; loc != nil {
+			lw.skipTo(loc.Filename, len(lw.sources[loc.Filename])+1, 0)
+		}
+	}
+	return lw.err
+}
+
+type listingWriter struct {
+	w       io.Writer
+	sources map[string][]string
+	// The last line printed from each source.
+	printed map[string]int
+	err     error
+}
+
+func sameFile(a, b *psec.Loc) bool {
+	return a != nil && b != nil && a.Filename == b.Filename
+}
+
+func sameLine(a, b *psec.Loc) bool {
+	return sameFile(a, b) && a.Line == b.Line
+}
+
+func (lw *listingWriter) lines(es []*Emission, depth int) {
+	for i := 0; i < len(es); {
+		// A line can hold several nodes, eg. labels before an instruction. Gather
+		// them into one row.
+		first := es[i]
+		addr := first.Address
+		var words []uint16
+		j := i
+		for ; j < len(es) && (j == i || sameLine(es[j].Loc, first.Loc)); j++ {
+			if len(words) == 0 {
+				addr = es[j].Address
+			}
+			words = append(words, es[j].Words...)
+		}
+
+		if first.Loc != nil {
+			lw.skipTo(first.Loc.Filename, first.Loc.Line, depth)
+		}
+		lw.row(addr, words, first.Loc, depth)
+		for _, e := range es[i:j] {
+			if len(e.Children) == 0 {
+				continue
+			}
+			// The lines of a conditional block are listed in place, since they're
+			// from the same file.
+			loc := e.Children[0].Loc
+			if sameFile(loc, first.Loc) {
+				lw.lines(e.Children, depth)
+				continue
+			}
+			lw.lines(e.Children, depth+1)
+			if loc != nil {
+				lw.skipTo(loc.Filename, len(lw.sources[loc.Filename])+1, depth+1)
+			}
+		}
+		i = j
+	}
+}
+
+// skipTo prints the lines of a source that didn't assemble to anything, like
+// comments and blank lines, up to but not including the given line.
+func (lw *listingWriter) skipTo(filename string, line, depth int) {
+	text := lw.sources[filename]
+	for l := lw.printed[filename] + 1; l < line && l <= len(text); l++ {
+		// Don't pad the end of the file with its trailing newline.
+		if l == len(text) && text[l-1] == "" {
+			break
+		}
+		lw.printf("%-8s %-*s %-24s %s%s\n", "", listingWidth*5-1, "",
+			fmt.Sprintf("%s:%d", filename, l), strings.Repeat("  ", depth),
+			strings.TrimSpace(text[l-1]))
+	}
+	if line-1 > lw.printed[filename] {
+		lw.printed[filename] = line - 1
+	}
+}
+
+func (lw *listingWriter) row(addr uint32, words []uint16, loc *psec.Loc, depth int) {
+	where, text := "", ""
+	if loc != nil {
+		where = fmt.Sprintf("%s:%d", loc.Filename, loc.Line)
+		if lines := lw.sources[loc.Filename]; loc.Line <= len(lines) {
+			text = strings.TrimSpace(lines[loc.Line-1])
+		}
+		lw.printed[loc.Filename] = loc.Line
+	}
+
+	for first := true; first || len(words) > 0; first = false {
+		chunk := words
+		if len(chunk) > listingWidth {
+			chunk = chunk[:listingWidth]
+		}
+		words = words[len(chunk):]
+
+		hex := make([]string, len(chunk))
+		for i, w := range chunk {
+			hex[i] = fmt.Sprintf("%04x", w)
+		}
+		if first {
+			lw.printf("%08x %-*s %-24s %s%s\n", addr, listingWidth*5-1,
+				strings.Join(hex, " "), where, strings.Repeat("  ", depth), text)
+		} else {
+			lw.printf("%08x %s\n", addr, strings.Join(hex, " "))
+		}
+		addr += uint32(len(chunk))
+	}
+}
+
+func (lw *listingWriter) printf(format string, args ...interface{}) {
+	if lw.err == nil {
+		_, lw.err = fmt.Fprintf(lw.w, format, args...)
+	}
+}
@@ -0,0 +1,49 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestListing(t *testing.T) {
+	a, res := assembleTest(t, `; Header comment
+.macro pair=.dat %0 %n .dat %1
+:start .dat 1, 2, 3, 4, 5
+pair 7, 8
+.org 0x20
+:end .dat end`)
+	if len(res.Diagnostics) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", res.Diagnostics)
+	}
+
+	var sb strings.Builder
+	if err := a.WriteListing(&sb, res); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{
+		"                             test:1                   ; Header comment",
+		"00000000                     test:2                   .macro pair=.dat %0 %n .dat %1",
+		"00000000 0001 0002 0003 0004 test:3                   :start .dat 1, 2, 3, 4, 5",
+		"00000004 0005",
+		"00000005                     test:4                   pair 7, 8",
+		"00000005 0007                test:4 (macro pair):1      .dat 7",
+		"00000006 0008                test:4 (macro pair):2      .dat 8",
+		"00000020                     test:5                   .org 0x20",
+		"00000020 0020                test:6                   :end .dat end",
+	}
+	actual := strings.Split(strings.TrimRight(sb.String(), "\n"), "\n")
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %d lines of listing, got:\n%s", len(expected), sb.String())
+	}
+	for i, line := range expected {
+		if strings.TrimRight(actual[i], " ") != line {
+			t.Errorf("listing line %d:\nexpected %q\n     got %q", i, line, actual[i])
+		}
+	}
+
+	// The listing also knows which node emitted the words.
+	if _, ok := res.Listing[2].Node.(*DatBlock); !ok {
+		t.Errorf("expected the .dat line to be recorded as a DatBlock, got %T", res.Listing[2].Node)
+	}
+}
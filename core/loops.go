@@ -0,0 +1,100 @@
+package core
+
+import "github.com/shepheb/psec"
+
+// Loops longer than this are reported as errors, rather than hanging the
+// assembler; it's already 256 times a DCPU's memory.
+const maxIterations = 16 * 1024 * 1024
+
+// RepBlock assembles its body Count times: .rep count ... .endr
+type RepBlock struct {
+	Count Expression
+	Body  *AST
+}
+
+// Assemble for RepBlock evaluates the count on every pass, and assembles the
+// body that many times.
+func (b *RepBlock) Assemble(s *AssemblyState) {
+	count := b.Count.Evaluate(s)
+	if count > maxIterations {
+		s.Errorf(b.Count.Location(), ".rep count %d is too large", count)
+		return
+	}
+	for i := uint32(0); i < count; i++ {
+		b.Body.Assemble(s)
+	}
+}
+
+// ForBlock assembles its body once for each value of a symbol, from Start up to
+// but not including End: .for var, start, end[, step] ... .endfor
+// Step defaults to 1, and can be negative to count down.
+type ForBlock struct {
+	Var   string
+	Start Expression
+	End   Expression
+	Step  Expression // nil for 1
+	Body  *AST
+	loc   *psec.Loc
+}
+
+// Assemble for ForBlock sets the loop variable as a symbol before each time
+// through the body, so any expression in it can use the variable.
+func (b *ForBlock) Assemble(s *AssemblyState) {
+	// Signed, so loops can count down to 0 or below.
+	i := int64(int32(b.Start.Evaluate(s)))
+	end := int64(int32(b.End.Evaluate(s)))
+	step := int64(1)
+	if b.Step != nil {
+		step = int64(int32(b.Step.Evaluate(s)))
+	}
+	if step == 0 {
+		s.Errorf(b.Step.Location(), ".for step can't be 0")
+		return
+	}
+	if (end-i)/step > maxIterations {
+		s.Errorf(b.loc, ".for loop over %s runs too many times", b.Var)
+		return
+	}
+
+	for ; (step > 0 && i < end) || (step < 0 && i > end); i += step {
+		s.updateSymbol(b.Var, uint32(i), b.loc)
+		b.Body.Assemble(s)
+	}
+}
+
+func addLoopParsers(g *psec.Grammar) {
+	g.WithAction("dir:rep",
+		psec.SeqAt(2, psec.Alt(litIC("rept"), litIC("rep")), sym("ws1"), sym("expr")),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			b := &RepBlock{Count: r.(Expression), Body: &AST{}}
+			return &blockMarker{kind: markLoop, name: "rep", loc: loc,
+				block: b, body: b.Body, end: "endr"}, nil
+		})
+
+	argSep := psec.Seq(ws(), lit(","), ws())
+	g.WithAction("dir:for",
+		psec.Seq(litIC("for"), sym("ws1"), sym("identifier"), argSep, sym("expr"), argSep,
+			sym("expr"), psec.Optional(psec.SeqAt(1, argSep, sym("expr")))),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			rs := r.([]interface{})
+			b := &ForBlock{Var: rs[2].(string), Start: rs[4].(Expression),
+				End: rs[6].(Expression), Body: &AST{}, loc: loc}
+			if step, ok := rs[7].(Expression); ok {
+				b.Step = step
+			}
+			return &blockMarker{kind: markLoop, name: "for", loc: loc,
+				block: b, body: b.Body, end: "endfor"}, nil
+		})
+
+	g.WithAction("dir:endr", litIC("endr"),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			return &blockMarker{kind: markEnd, name: "endr", loc: loc}, nil
+		})
+	g.WithAction("dir:endfor", litIC("endfor"),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			return &blockMarker{kind: markEnd, name: "endfor", loc: loc}, nil
+		})
+
+	g.AddSymbol("dir:loop",
+		psec.Alt(sym("dir:rep"), sym("dir:for"), sym("dir:endr"), sym("dir:endfor")))
+}
@@ -0,0 +1,74 @@
+package core
+
+import "testing"
+
+func TestRep(t *testing.T) {
+	_, res := assembleTest(t, `
+.rep 3
+  .dat 7
+.endr
+.rep 0
+  .dat 10
+.endr`)
+	expectWords(t, res, 7, 7, 7)
+
+	_, res = assembleTest(t, `
+.def count, 2
+.rept count
+  .dat 8
+  .rep 2
+    .dat 9
+  .endr
+.endr`)
+	expectWords(t, res, 8, 9, 9, 8, 9, 9)
+}
+
+func TestFor(t *testing.T) {
+	_, res := assembleTest(t, `
+.for i, 0, 4
+  .dat i * i
+.endfor
+.for i, 10, 0, -3
+  .dat i
+.endfor
+.for row, 0, 2
+  .for col, 0, 2
+    .dat row << 4 | col
+  .endfor
+.endfor
+.dat i`)
+	expectWords(t, res, 0, 1, 4, 9, 10, 7, 4, 1, 0x00, 0x01, 0x10, 0x11, 1)
+}
+
+func TestLoopLabels(t *testing.T) {
+	// Labels around loops settle across passes, and numeric labels inside them
+	// are distinct on each time through.
+	_, res := assembleTest(t, `
+.dat end
+.for i, 0, 3
+:1 .dat 1b
+.endfor
+:end`)
+	expectWords(t, res, 4, 1, 2, 3)
+}
+
+func TestLoopErrors(t *testing.T) {
+	cases := []struct {
+		src  string
+		msg  string
+		line int
+	}{
+		{".rep 2\n.dat 1", ".rep without .endr", 1},
+		{".for i, 0, 2\n.dat 1\n.endr", ".endr without .rep", 3},
+		{".if 1\n.rep 2\n.endif\n.endr", ".endif without .if", 3},
+		{".for i, 0, 2, 0\n.endfor", ".for step can't be 0", 1},
+		{".rep 0x7fffffff\n.endr", ".rep count 2147483647 is too large", 1},
+	}
+	for _, c := range cases {
+		_, res := assembleTest(t, c.src)
+		ds := res.Diagnostics
+		if len(ds) == 0 || ds[0].Message != c.msg || ds[0].Loc.Line != c.line {
+			t.Errorf("%q: expected %q on line %d, got %v", c.src, c.msg, c.line, ds)
+		}
+	}
+}
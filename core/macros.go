@@ -8,34 +8,52 @@ import (
 	"github.com/shepheb/psec"
 )
 
-var macros map[string]string
+// macro is the definition of a macro. One-line macros (.macro name=body) have
+// no params, and refer to their arguments as %0, %1, etc. Block macros
+// (.macro name a, b ... .endm) can also use their params by name, as \a.
+type macro struct {
+	body   string
+	params []macroParam
+}
 
-// TODO This would probably be better handled with improving psec to allow
-// carrying user parser state.
-func FreshMacros() {
-	macros = map[string]string{}
+// macroParam is a named macro parameter.
+type macroParam struct {
+	name       string
+	def        string // Used when the argument is missing, if hasDefault.
+	hasDefault bool
+	// Variadic params are last, and collect the rest of the arguments, with
+	// their commas.
+	variadic bool
 }
 
-func addMacro(name, body string) {
-	macros[name] = body
+func (a *Assembler) addMacro(name string, m *macro) {
+	a.macros[name] = m
 }
 
-func isMacro(name string) bool {
-	_, ok := macros[name]
+func (a *Assembler) isMacro(name string) bool {
+	_, ok := a.macros[name]
 	return ok
 }
 
 // This just does the string replacements, the Assemble routine is responsible
 // for inline parsing.
 func doMacro(s *AssemblyState, name string, args []string) (string, error) {
-	text := macros[name]
+	m := s.asm.macros[name]
+	text := m.body
+	if len(m.params) > 0 {
+		values, err := m.bind(name, args)
+		if err != nil {
+			return "", err
+		}
+		text = substituteParams(text, values)
+	}
 
 	for i, arg := range args {
 		basic := fmt.Sprintf("%%%d", i)   // %i
 		evaled := fmt.Sprintf("%%e%d", i) // %ei
 
 		if strings.Contains(text, evaled) {
-			expr, err := currentDriver.ParseExpr("macro expr", strings.TrimSpace(arg))
+			expr, err := s.asm.driver.ParseExpr("macro expr", strings.TrimSpace(arg))
 			if err != nil {
 				return "", fmt.Errorf("Could not parse expression for %s: %v", evaled, err)
 			}
@@ -48,29 +66,274 @@ func doMacro(s *AssemblyState, name string, args []string) (string, error) {
 
 	text = strings.ReplaceAll(text, "%n", "\n")
 
+	// Every expansion gets its own number, for unique label names.
+	s.expansions++
+	text = strings.ReplaceAll(text, "\\@", strconv.Itoa(s.expansions))
+	text = localizeLabels(text, fmt.Sprintf("__%d", s.expansions))
+
 	//fmt.Printf("Macro: %s %v\n%s\n=========\n", name, args, text)
 	return text, nil
 }
 
-func addMacroParsers(g *psec.Grammar) {
+// bind matches the arguments of a macro use to the macro's params.
+func (m *macro) bind(name string, args []string) (map[string]string, error) {
+	values := map[string]string{}
+	for i, p := range m.params {
+		switch {
+		case p.variadic:
+			values[p.name] = ""
+			if i < len(args) {
+				values[p.name] = strings.Join(args[i:], ", ")
+			}
+			return values, nil
+		case i < len(args):
+			values[p.name] = args[i]
+		case p.hasDefault:
+			values[p.name] = p.def
+		default:
+			return nil, fmt.Errorf("macro %s needs an argument for '%s'", name, p.name)
+		}
+	}
+	if len(args) > len(m.params) {
+		return nil, fmt.Errorf("macro %s takes %d arguments, got %d", name, len(m.params), len(args))
+	}
+	return values, nil
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' ||
+		'A' <= c && c <= 'Z'
+}
+
+// substituteParams replaces \name with the value of each param. \() expands to
+// nothing, to separate a param from identifier characters after it, as in
+// \name\()_end. Other backslashes are left alone, as is quoted text, where
+// backslashes are escapes like \n.
+func substituteParams(text string, values map[string]string) string {
+	var sb strings.Builder
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && i+1 < len(text) {
+				sb.WriteByte(c)
+				i++
+				c = text[i]
+			} else if c == quote || c == '\n' {
+				// Quotes end at the line, so an apostrophe in a comment
+				// doesn't hide the params after it.
+				quote = 0
+			}
+			sb.WriteByte(c)
+			continue
+		case c == '"' || c == '\'':
+			quote = c
+		}
+		if c != '\\' {
+			sb.WriteByte(c)
+			continue
+		}
+		if strings.HasPrefix(text[i:], "\\()") {
+			i += 2
+			continue
+		}
+
+		j := i + 1
+		for j < len(text) && isIdentChar(text[j]) {
+			j++
+		}
+		if value, ok := values[text[i+1:j]]; ok {
+			sb.WriteString(value)
+			i = j - 1
+		} else {
+			sb.WriteByte('\\')
+		}
+	}
+	return sb.String()
+}
+
+// localizeLabels handles .local lines in a macro expansion, which list names
+// that are private to the expansion. The .local lines are blanked, and the names
+// get the suffix everywhere they appear, outside of strings.
+func localizeLabels(text, suffix string) string {
+	lines := strings.Split(text, "\n")
+	locals := map[string]bool{}
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if len(trimmed) < 7 || !strings.EqualFold(trimmed[:6], ".local") ||
+			(trimmed[6] != ' ' && trimmed[6] != '\t') {
+			continue
+		}
+		if semi := strings.Index(trimmed, ";"); semi >= 0 {
+			trimmed = trimmed[:semi]
+		}
+		for _, name := range strings.Split(trimmed[7:], ",") {
+			locals[strings.TrimSpace(name)] = true
+		}
+		// Blank rather than remove it, to keep the line numbers.
+		lines[i] = ""
+	}
+	if len(locals) == 0 {
+		return text
+	}
+	text = strings.Join(lines, "\n")
+
+	var sb strings.Builder
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && i+1 < len(text) {
+				sb.WriteByte(c)
+				i++
+				c = text[i]
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case isIdentChar(c):
+			j := i
+			for j < len(text) && isIdentChar(text[j]) {
+				j++
+			}
+			word := text[i:j]
+			sb.WriteString(word)
+			if locals[word] {
+				sb.WriteString(suffix)
+			}
+			i = j - 1
+			continue
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
+
+// splitMacroArgs splits the text after a macro's name into arguments, at the
+// commas which aren't inside brackets or quotes.
+func splitMacroArgs(text string) []string {
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+
+	var args []string
+	depth := 0
+	var quote byte
+	start := 0
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(' || c == '[' || c == '{':
+			depth++
+		case (c == ')' || c == ']' || c == '}') && depth > 0:
+			depth--
+		case c == ',' && depth == 0:
+			args = append(args, strings.TrimSpace(text[start:i]))
+			start = i + 1
+		}
+	}
+	return append(args, strings.TrimSpace(text[start:]))
+}
+
+func addMacroParsers(g *psec.Grammar, a *Assembler) {
+	// One-line macros: .macro name=body, with %n for newlines.
+	g.WithAction("dir:macro line",
+		psec.Seq(litIC("macro"), sym("wsline"), sym("identifier"), sym("wsline"),
+			lit("="), psec.Stringify(psec.Many1(psec.NoneOf("\n")))),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			rs := r.([]interface{})
+			ident := rs[2].(string)
+			m := &macro{body: rs[5].(string)}
+			a.addMacro(ident, m)
+			return &MacroDef{name: ident, macro: m}, nil
+		})
+
+	// Block macros: .macro name a, b=default, rest... on the first line, then
+	// the body up to a line starting with .endm. They don't nest.
+	g.WithAction("macro param",
+		psec.Seq(sym("identifier"), psec.Optional(psec.Alt(lit("..."),
+			psec.SeqAt(3, sym("wsline"), lit("="), sym("wsline"),
+				psec.Stringify(psec.Many1(psec.NoneOf(",;\n"))))))),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			rs := r.([]interface{})
+			p := macroParam{name: rs[0].(string)}
+			if rs[1] == "..." {
+				p.variadic = true
+			} else if def, ok := rs[1].(string); ok {
+				p.def = strings.TrimSpace(def)
+				p.hasDefault = true
+			}
+			return p, nil
+		})
+	g.WithAction("dir:macro block",
+		psec.Seq(litIC("macro"), sym("ws1"), sym("identifier"),
+			psec.Optional(psec.SeqAt(1, sym("ws1"),
+				psec.SepBy(sym("macro param"), psec.Seq(sym("wsline"), lit(","), sym("wsline"))))),
+			sym("wsline"), psec.Optional(sym("comment")),
+			psec.Stringify(psec.ManyTill(psec.AnyChar(),
+				psec.Seq(lit("\n"), sym("wsline"), litIC(".endm"))))),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			rs := r.([]interface{})
+			ident := rs[2].(string)
+			// The body starts with the newline ending the .macro line.
+			m := &macro{body: strings.TrimPrefix(rs[6].(string), "\n")}
+
+			seen := map[string]bool{}
+			if params, ok := rs[3].([]interface{}); ok {
+				for i, raw := range params {
+					p := raw.(macroParam)
+					if seen[p.name] {
+						return nil, fmt.Errorf("macro %s has two params named '%s'", ident, p.name)
+					}
+					if p.variadic && i != len(params)-1 {
+						return nil, fmt.Errorf("macro %s: only the last param can be variadic", ident)
+					}
+					seen[p.name] = true
+					m.params = append(m.params, p)
+				}
+			}
+			a.addMacro(ident, m)
+			return &MacroDef{name: ident, macro: m}, nil
+		})
+	g.AddSymbol("dir:macro", psec.Alt(sym("dir:macro line"), sym("dir:macro block")))
+
 	// This is even looser than an instruction, just a name and comma-separated
 	// list, but the name must be defined as a macro or the action errors out.
 	// This rule should be used as the last option for a legal line of assembly.
+	quoted := func(quote string) psec.Parser {
+		return psec.Stringify(psec.Seq(lit(quote),
+			psec.Many(psec.Alt(psec.Seq(lit("\\"), psec.NoneOf("\n")),
+				psec.NoneOf(quote+"\\\n"))),
+			lit(quote)))
+	}
+	// Keep the quotes, and any ; or , inside them.
+	g.AddSymbol("macro arg string", quoted("\""))
+	g.AddSymbol("macro arg char", quoted("'"))
 	g.WithAction("macro use",
-		psec.Seq(sym("identifier"), psec.Optional(
-			psec.SeqAt(1, sym("ws1"), psec.SepBy(psec.Stringify(psec.Many1(psec.NoneOf(",;\n"))), lit(","))))),
+		psec.Seq(sym("identifier"), psec.Optional(psec.SeqAt(1, sym("ws1"),
+			psec.Stringify(psec.Many1(psec.Alt(sym("macro arg string"), sym("macro arg char"),
+				psec.NoneOf(";\n\"'"))))))),
 		func(r interface{}, loc *psec.Loc) (interface{}, error) {
 			rs := r.([]interface{})
 			macro := rs[0].(string)
-			if !isMacro(macro) {
+			if !a.isMacro(macro) {
 				return nil, fmt.Errorf("unknown macro %s", macro)
 			}
 
 			var args []string
-			if rawArgs, ok := rs[1].([]interface{}); ok {
-				for _, arg := range rawArgs {
-					args = append(args, strings.TrimSpace(arg.(string)))
-				}
+			if rawArgs, ok := rs[1].(string); ok {
+				args = splitMacroArgs(rawArgs)
 			}
 			return &MacroUse{macro: macro, args: args, loc: loc}, nil
 		})
@@ -0,0 +1,151 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBlockMacro(t *testing.T) {
+	_, res := assembleTest(t, `
+.macro pair first, second=0x22 ; A comment
+  .dat \first
+  .dat \second
+.endm
+pair 1, 2
+pair 3
+.dat 4`)
+	expectWords(t, res, 1, 2, 3, 0x22, 4)
+}
+
+func TestBlockMacroNoParams(t *testing.T) {
+	_, res := assembleTest(t, `
+.macro two
+.dat 2
+.endm
+.macro empty
+.endm
+two
+empty
+two`)
+	expectWords(t, res, 2, 2)
+}
+
+func TestVariadicMacro(t *testing.T) {
+	_, res := assembleTest(t, `
+.macro table count, items...
+.dat \count
+.dat \items
+.endm
+table 3, 7, 8, 9
+table 1, 5`)
+	expectWords(t, res, 3, 7, 8, 9, 1, 5)
+}
+
+func TestMacroArgsWithCommas(t *testing.T) {
+	// The commas in parentheses and the string don't split the arguments.
+	_, res := assembleTest(t, `
+.macro both x, s
+.dat \x, \s
+.endm
+both (1 + 2) * 3, "a;b,c"`)
+	expectWords(t, res, 9, 'a', ';', 'b', ',', 'c')
+}
+
+func TestMacroPercentArgs(t *testing.T) {
+	// Block macros can still use %N.
+	_, res := assembleTest(t, `
+.macro sum a, b
+.dat %0 + %1, \a
+.endm
+sum 1, 2`)
+	expectWords(t, res, 3, 1)
+}
+
+func TestMacroParamSeparator(t *testing.T) {
+	_, res := assembleTest(t, `
+.macro labelled name
+:\name\()_start .dat \name\()_start
+.endm
+labelled foo
+labelled bar`)
+	expectWords(t, res, 0, 1)
+}
+
+func TestMacroArgErrors(t *testing.T) {
+	cases := map[string]string{
+		"pair 1":       "macro pair needs an argument for 'b'",
+		"pair 1, 2, 3": "macro pair takes 2 arguments, got 3",
+	}
+	for use, msg := range cases {
+		_, res := assembleTest(t, ".macro pair a, b\n.dat \\a, \\b\n.endm\n"+use)
+		if len(res.Diagnostics) != 1 || !strings.Contains(res.Diagnostics[0].Message, msg) {
+			t.Errorf("%s: expected %q, got %v", use, msg, res.Diagnostics)
+		}
+	}
+}
+
+func TestSplitMacroArgs(t *testing.T) {
+	cases := map[string][]string{
+		"":                      nil,
+		"a":                     {"a"},
+		" a , b ":               {"a", "b"},
+		"f(a, b), [c, d]":       {"f(a, b)", "[c, d]"},
+		`"x, \"y", ','`:         {`"x, \"y"`, `','`},
+		"a,,b":                  {"a", "", "b"},
+		"{a, (b, c)}, d":        {"{a, (b, c)}", "d"},
+		"unbalanced), still, 3": {"unbalanced)", "still", "3"},
+	}
+	for text, expected := range cases {
+		args := splitMacroArgs(text)
+		if len(args) != len(expected) {
+			t.Errorf("%q: expected %q, got %q", text, expected, args)
+			continue
+		}
+		for i := range args {
+			if args[i] != expected[i] {
+				t.Errorf("%q: expected %q, got %q", text, expected, args)
+				break
+			}
+		}
+	}
+}
+
+func TestMacroUniqueLabels(t *testing.T) {
+	_, res := assembleTest(t, `
+.macro skip n
+:skip\@ .dat skip\@ + \n
+.endm
+.macro one=:l\@ .dat l\@
+skip 1
+skip 2
+one
+one`)
+	expectWords(t, res, 1, 3, 2, 3)
+}
+
+func TestMacroLocal(t *testing.T) {
+	_, res := assembleTest(t, `
+.macro loop n
+  .local top, end ; private to each use
+  :top .dat end, "top"
+  :end .dat top + \n
+.endm
+.dat top__2
+loop 10
+loop 20`)
+	// Forward references to labels in expansions resolve on later passes.
+	expectWords(t, res, 6,
+		5, 't', 'o', 'p', 1+10,
+		10, 't', 'o', 'p', 6+20)
+}
+
+func TestMacroParamsInStrings(t *testing.T) {
+	// Escapes in quoted text aren't params, even when one has the same name.
+	_, res := assembleTest(t, `
+.macro m n, t ; Doesn't use quotes
+.asciiz "x\n"
+.dat '\t', \n, \t
+.endm
+m 7, 8`)
+	expectWords(t, res, 'x', '\n', 0, '\t', 7, 8)
+}
@@ -0,0 +1,89 @@
+package core
+
+import "sort"
+
+// Memory is pages of this many words, allocated as they're written.
+const (
+	pageBits = 12
+	pageSize = 1 << pageBits
+	pageMask = pageSize - 1
+)
+
+// Memory is a sparse memory image covering the full 32-bit address space. It
+// only allocates the pages that have been written, and tracks which words were
+// written, so the image can be exported as segments.
+type Memory struct {
+	pages map[uint32]*page
+}
+
+type page struct {
+	words [pageSize]uint16
+	used  [pageSize / 64]uint64 // A bit per word.
+}
+
+// NewMemory creates an empty Memory.
+func NewMemory() *Memory {
+	return &Memory{pages: map[uint32]*page{}}
+}
+
+// Write sets the word at addr. It returns true if the word had already been
+// written.
+func (m *Memory) Write(addr uint32, x uint16) bool {
+	p, ok := m.pages[addr>>pageBits]
+	if !ok {
+		p = &page{}
+		m.pages[addr>>pageBits] = p
+	}
+	i := addr & pageMask
+	bit := uint64(1) << (i % 64)
+	written := p.used[i/64]&bit != 0
+	p.used[i/64] |= bit
+	p.words[i] = x
+	return written
+}
+
+// Read gives the word at addr, which is 0 if it hasn't been written.
+func (m *Memory) Read(addr uint32) uint16 {
+	if p, ok := m.pages[addr>>pageBits]; ok {
+		return p.words[addr&pageMask]
+	}
+	return 0
+}
+
+// Written is true if the word at addr has been written.
+func (m *Memory) Written(addr uint32) bool {
+	if p, ok := m.pages[addr>>pageBits]; ok {
+		i := addr & pageMask
+		return p.used[i/64]&(1<<(i%64)) != 0
+	}
+	return false
+}
+
+// Segments gives the runs of written words, in address order. Runs continue
+// across page boundaries.
+func (m *Memory) Segments() []Segment {
+	var numbers []uint32
+	for n := range m.pages {
+		numbers = append(numbers, n)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+
+	var segs []Segment
+	var seg *Segment
+	for _, n := range numbers {
+		p := m.pages[n]
+		for i := uint32(0); i < pageSize; i++ {
+			if p.used[i/64]&(1<<(i%64)) == 0 {
+				seg = nil
+				continue
+			}
+			addr := n<<pageBits | i
+			if seg == nil || seg.Start+uint32(len(seg.Words)) != addr {
+				segs = append(segs, Segment{Start: addr})
+				seg = &segs[len(segs)-1]
+			}
+			seg.Words = append(seg.Words, p.words[i])
+		}
+	}
+	return segs
+}
@@ -0,0 +1,93 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMemory(t *testing.T) {
+	m := NewMemory()
+	if m.Write(5, 1) || m.Write(6, 2) {
+		t.Errorf("fresh words reported as already written")
+	}
+	if !m.Write(6, 3) {
+		t.Errorf("rewritten word not reported")
+	}
+	// A run across a page boundary, and one at the top of memory.
+	m.Write(pageSize-1, 4)
+	m.Write(pageSize, 5)
+	m.Write(0xffffffff, 6)
+
+	if m.Read(6) != 3 || m.Read(7) != 0 || m.Read(0xffffffff) != 6 {
+		t.Errorf("wrong values read back")
+	}
+	if !m.Written(pageSize) || m.Written(pageSize+1) || m.Written(0x80000000) {
+		t.Errorf("wrong written flags")
+	}
+
+	segs := m.Segments()
+	expected := []Segment{
+		{Start: 5, Words: []uint16{1, 3}},
+		{Start: pageSize - 1, Words: []uint16{4, 5}},
+		{Start: 0xffffffff, Words: []uint16{6}},
+	}
+	if len(segs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, segs)
+	}
+	for i, seg := range expected {
+		if segs[i].Start != seg.Start || len(segs[i].Words) != len(seg.Words) {
+			t.Errorf("expected segment %v, got %v", seg, segs[i])
+			continue
+		}
+		for j, w := range seg.Words {
+			if segs[i].Words[j] != w {
+				t.Errorf("expected segment %v, got %v", seg, segs[i])
+			}
+		}
+	}
+
+	// ROM images are built from the segments.
+	image := imageOf(segs[:1], 8, 0xffff)
+	if len(image) != 8 || image[4] != 0xffff || image[5] != 1 || image[6] != 3 ||
+		image[7] != 0xffff {
+		t.Errorf("wrong image: %v", image)
+	}
+}
+
+func TestHighAddresses(t *testing.T) {
+	_, res := assembleTest(t, `
+.dat 1
+.org 0x12345678
+.dat 2, 3`)
+	if len(res.Diagnostics) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", res.Diagnostics)
+	}
+	// Only the segments, since the ROM image would run to the highest address.
+	if len(res.Segments) != 2 || res.Segments[1].Start != 0x12345678 ||
+		len(res.Segments[1].Words) != 2 || res.Segments[1].Words[1] != 3 {
+		t.Errorf("wrong segments: %v", res.Segments)
+	}
+}
+
+func TestTopAddress(t *testing.T) {
+	// The last word of the address space can be written, but not the next.
+	_, res := assembleTest(t, ".org 0xffffffff\n.dat 1")
+	if len(res.Diagnostics) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", res.Diagnostics)
+	}
+	if len(res.Segments) != 1 || res.Segments[0].Start != 0xffffffff || res.end != 1<<32 {
+		t.Errorf("wrong segments: %v, ending at %x", res.Segments, res.end)
+	}
+	if rom := res.ROM(); rom != nil {
+		t.Errorf("expected no ROM image, got %d words", len(rom))
+	}
+
+	_, res = assembleTest(t, ".org 0xfffffffe\n.dat 1, 2, 3, 4\n.org 0\n.dat 5")
+	if len(res.Diagnostics) != 1 || res.Diagnostics[0].Loc.Line != 2 ||
+		!strings.Contains(res.Diagnostics[0].Message, "wrapped past $ffffffff") {
+		t.Errorf("expected an error for wrapping on line 2, got %v", res.Diagnostics)
+	}
+	if len(res.Segments) != 2 || res.Segments[0].Start != 0 || len(res.Segments[1].Words) != 2 {
+		t.Errorf("wrong segments: %v", res.Segments)
+	}
+}
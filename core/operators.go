@@ -17,19 +17,57 @@ const (
 	OR
 	XOR
 	NOT
+	MOD
+	EQ
+	NE
+	LT
+	LE
+	GT
+	GE
+	SLT // Signed comparisons
+	SLE
+	SGT
+	SGE
+	LAND // Logical &&, || and !
+	LOR
+	LNOT
 	ILLEGAL
 )
 
 // OperatorNames maps operator name strings to the internal values.
 var OperatorNames map[string]Operator = map[string]Operator{
-	"+":  PLUS,
-	"-":  MINUS,
-	"*":  TIMES,
-	"/":  DIVIDE,
-	"<<": LANGLES,
-	">>": RANGLES,
-	"&":  AND,
-	"|":  OR,
-	"^":  XOR,
-	"~":  NOT,
+	"+":   PLUS,
+	"-":   MINUS,
+	"*":   TIMES,
+	"/":   DIVIDE,
+	"<<":  LANGLES,
+	">>":  RANGLES,
+	"&":   AND,
+	"|":   OR,
+	"^":   XOR,
+	"~":   NOT,
+	"%":   MOD,
+	"==":  EQ,
+	"!=":  NE,
+	"<":   LT,
+	"<=":  LE,
+	">":   GT,
+	">=":  GE,
+	"slt": SLT,
+	"sle": SLE,
+	"sgt": SGT,
+	"sge": SGE,
+	"&&":  LAND,
+	"||":  LOR,
+	"!":   LNOT,
+}
+
+// String for Operator gives its name in source.
+func (op Operator) String() string {
+	for name, o := range OperatorNames {
+		if o == op {
+			return name
+		}
+	}
+	return "ILLEGAL"
 }
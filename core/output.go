@@ -0,0 +1,269 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Segment is a contiguous run of assembled words, starting at a word address.
+type Segment struct {
+	Start uint32
+	Words []uint16
+}
+
+// OutputFormat writes an assembled memory image, given as segments in address
+// order, to a file.
+type OutputFormat interface {
+	Write(w io.Writer, segs []Segment) error
+}
+
+// OutputFormatFunc adapts a function to OutputFormat.
+type OutputFormatFunc func(w io.Writer, segs []Segment) error
+
+// Write for OutputFormatFunc calls the function.
+func (f OutputFormatFunc) Write(w io.Writer, segs []Segment) error { return f(w, segs) }
+
+// SparseFormat is an OutputFormat that records addresses, so it can be given
+// just the segments that were written, rather than one image with the gaps
+// filled.
+type SparseFormat interface {
+	OutputFormat
+	Sparse() bool
+}
+
+// SparseFormatFunc adapts a function to SparseFormat.
+type SparseFormatFunc func(w io.Writer, segs []Segment) error
+
+// Write for SparseFormatFunc calls the function.
+func (f SparseFormatFunc) Write(w io.Writer, segs []Segment) error { return f(w, segs) }
+
+// Sparse for SparseFormatFunc is always true.
+func (f SparseFormatFunc) Sparse() bool { return true }
+
+// OutputFormats holds the formats that can be chosen with -format, by name.
+// Add to it to support a new format.
+var OutputFormats = map[string]OutputFormat{
+	"bin":  OutputFormatFunc(writeBigEndian),
+	"le":   OutputFormatFunc(writeLittleEndian),
+	"ihex": SparseFormatFunc(writeIntelHex),
+	"srec": SparseFormatFunc(writeSRecords),
+	"hex":  OutputFormatFunc(writeHexText),
+}
+
+// OutputFormatNames lists the keys of OutputFormats, sorted.
+func OutputFormatNames() []string {
+	var names []string
+	for name := range OutputFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// flatten lays the segments out as a single image starting at address 0, with
+// any gaps zeroed, for formats without addresses.
+func flatten(segs []Segment) []uint16 {
+	end := uint32(0)
+	for _, seg := range segs {
+		if e := seg.Start + uint32(len(seg.Words)); e > end {
+			end = e
+		}
+	}
+	return imageOf(segs, end, 0)
+}
+
+// maxImageWords is the largest image MasterAssembler or Result.ROM will build
+// for a format without addresses: 32MB, as much as drasm always allocated
+// before it had sparse memory.
+const maxImageWords = 16 * 1024 * 1024
+
+// imageOf lays the segments out as a single image from address 0 up to but not
+// including end, with any gaps filled.
+func imageOf(segs []Segment, end uint32, fill uint16) []uint16 {
+	if end == 0 {
+		return nil
+	}
+	image := make([]uint16, end)
+	if fill != 0 {
+		for i := range image {
+			image[i] = fill
+		}
+	}
+	for _, seg := range segs {
+		if seg.Start >= end {
+			continue
+		}
+		words := seg.Words
+		if seg.Start+uint32(len(words)) > end {
+			words = words[:end-seg.Start]
+		}
+		copy(image[seg.Start:], words)
+	}
+	return image
+}
+
+// bytesOf splits words into bytes, high byte first.
+func bytesOf(words []uint16) []byte {
+	bs := make([]byte, 0, 2*len(words))
+	for _, w := range words {
+		bs = append(bs, byte(w>>8), byte(w))
+	}
+	return bs
+}
+
+func writeBigEndian(w io.Writer, segs []Segment) error {
+	_, err := w.Write(bytesOf(flatten(segs)))
+	return err
+}
+
+func writeLittleEndian(w io.Writer, segs []Segment) error {
+	image := flatten(segs)
+	bs := make([]byte, 0, 2*len(image))
+	for _, word := range image {
+		bs = append(bs, byte(word), byte(word>>8))
+	}
+	_, err := w.Write(bs)
+	return err
+}
+
+// writeHexText writes one word per line, as four hex digits.
+func writeHexText(w io.Writer, segs []Segment) error {
+	for _, word := range flatten(segs) {
+		if _, err := fmt.Fprintf(w, "%04x\n", word); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Data bytes per record, for Intel HEX and S-records.
+const recordSize = 16
+
+// checkByteAddresses makes sure the segments' byte addresses, twice their word
+// addresses, fit in 32 bits for Intel HEX and S-records.
+func checkByteAddresses(segs []Segment) error {
+	for _, seg := range segs {
+		if end := uint64(seg.Start) + uint64(len(seg.Words)); end > 1<<31 {
+			return fmt.Errorf("word address $%x is too high for byte-addressed records", end-1)
+		}
+	}
+	return nil
+}
+
+// writeIntelHex writes Intel HEX records. Addresses in the file are byte
+// addresses, so word N is at byte 2N, high byte first. Extended linear address
+// records cover images past 64KB.
+func writeIntelHex(w io.Writer, segs []Segment) error {
+	if err := checkByteAddresses(segs); err != nil {
+		return err
+	}
+	record := func(kind byte, addr uint16, data []byte) error {
+		sum := byte(len(data)) + byte(addr>>8) + byte(addr) + kind
+		var sb strings.Builder
+		fmt.Fprintf(&sb, ":%02X%04X%02X", len(data), addr, kind)
+		for _, b := range data {
+			fmt.Fprintf(&sb, "%02X", b)
+			sum += b
+		}
+		fmt.Fprintf(&sb, "%02X\n", -sum)
+		_, err := io.WriteString(w, sb.String())
+		return err
+	}
+
+	upper := uint32(0)
+	for _, seg := range segs {
+		bs := bytesOf(seg.Words)
+		addr := 2 * seg.Start
+		for len(bs) > 0 {
+			// Records can't cross a 64KB boundary.
+			n := recordSize
+			if n > len(bs) {
+				n = len(bs)
+			}
+			if room := 0x10000 - int(addr&0xffff); n > room {
+				n = room
+			}
+
+			if addr>>16 != upper {
+				upper = addr >> 16
+				if err := record(4, 0, []byte{byte(upper >> 8), byte(upper)}); err != nil {
+					return err
+				}
+			}
+			if err := record(0, uint16(addr), bs[:n]); err != nil {
+				return err
+			}
+			bs = bs[n:]
+			addr += uint32(n)
+		}
+	}
+	return record(1, 0, nil)
+}
+
+// writeSRecords writes Motorola S-records, with byte addresses as for Intel
+// HEX. The address width is the smallest of S1, S2 or S3 that fits the image.
+func writeSRecords(w io.Writer, segs []Segment) error {
+	if err := checkByteAddresses(segs); err != nil {
+		return err
+	}
+	end := uint32(0)
+	for _, seg := range segs {
+		if e := 2 * (seg.Start + uint32(len(seg.Words))); e > end {
+			end = e
+		}
+	}
+	addrBytes, dataKind, endKind := 2, '1', '9'
+	if end > 0x1000000 {
+		addrBytes, dataKind, endKind = 4, '3', '7'
+	} else if end > 0x10000 {
+		addrBytes, dataKind, endKind = 3, '2', '8'
+	}
+
+	record := func(kind rune, addrBytes int, addr uint32, data []byte) error {
+		count := byte(addrBytes + len(data) + 1)
+		sum := count
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "S%c%02X", kind, count)
+		for i := addrBytes - 1; i >= 0; i-- {
+			b := byte(addr >> (8 * uint(i)))
+			fmt.Fprintf(&sb, "%02X", b)
+			sum += b
+		}
+		for _, b := range data {
+			fmt.Fprintf(&sb, "%02X", b)
+			sum += b
+		}
+		fmt.Fprintf(&sb, "%02X\n", ^sum)
+		_, err := io.WriteString(w, sb.String())
+		return err
+	}
+
+	if err := record('0', 2, 0, []byte("drasm")); err != nil {
+		return err
+	}
+	count := 0
+	for _, seg := range segs {
+		bs := bytesOf(seg.Words)
+		addr := 2 * seg.Start
+		for len(bs) > 0 {
+			n := recordSize
+			if n > len(bs) {
+				n = len(bs)
+			}
+			if err := record(dataKind, addrBytes, addr, bs[:n]); err != nil {
+				return err
+			}
+			count++
+			bs = bs[n:]
+			addr += uint32(n)
+		}
+	}
+	if count <= 0xffff {
+		if err := record('5', 2, uint32(count), nil); err != nil {
+			return err
+		}
+	}
+	return record(endKind, addrBytes, 0, nil)
+}
@@ -0,0 +1,68 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+)
+
+func writeFormat(t *testing.T, name string, segs []Segment) string {
+	var buf bytes.Buffer
+	if err := OutputFormats[name].Write(&buf, segs); err != nil {
+		t.Fatalf("unexpected error writing %s: %v", name, err)
+	}
+	return buf.String()
+}
+
+// Two words at 0, a gap, and one word at 3.
+var testSegs = []Segment{
+	{Start: 0, Words: []uint16{0x1234, 0xabcd}},
+	{Start: 3, Words: []uint16{0x0001}},
+}
+
+func TestRawFormats(t *testing.T) {
+	if out := writeFormat(t, "bin", testSegs); out != "\x12\x34\xab\xcd\x00\x00\x00\x01" {
+		t.Errorf("wrong big-endian output: % x", out)
+	}
+	if out := writeFormat(t, "le", testSegs); out != "\x34\x12\xcd\xab\x00\x00\x01\x00" {
+		t.Errorf("wrong little-endian output: % x", out)
+	}
+	if out := writeFormat(t, "hex", testSegs); out != "1234\nabcd\n0000\n0001\n" {
+		t.Errorf("wrong hex text output:\n%s", out)
+	}
+}
+
+func TestIntelHex(t *testing.T) {
+	expected := ":040000001234ABCD3E\n" +
+		":020006000001F7\n" +
+		":00000001FF\n"
+	if out := writeFormat(t, "ihex", testSegs); out != expected {
+		t.Errorf("wrong Intel HEX output:\n%s", out)
+	}
+
+	// Word $8000 is at byte $10000, past the first 64KB.
+	expected = ":020000040001F9\n" +
+		":02000000BEEF51\n" +
+		":00000001FF\n"
+	if out := writeFormat(t, "ihex", []Segment{{Start: 0x8000, Words: []uint16{0xbeef}}}); out != expected {
+		t.Errorf("wrong extended Intel HEX output:\n%s", out)
+	}
+}
+
+func TestSRecords(t *testing.T) {
+	expected := "S0080000647261736DE0\n" +
+		"S10700001234ABCD3A\n" +
+		"S10500060001F3\n" +
+		"S5030002FA\n" +
+		"S9030000FC\n"
+	if out := writeFormat(t, "srec", testSegs); out != expected {
+		t.Errorf("wrong S-record output:\n%s", out)
+	}
+
+	expected = "S0080000647261736DE0\n" +
+		"S206010000BEEF4B\n" +
+		"S5030001FB\n" +
+		"S804000000FB\n"
+	if out := writeFormat(t, "srec", []Segment{{Start: 0x8000, Words: []uint16{0xbeef}}}); out != expected {
+		t.Errorf("wrong S2 output:\n%s", out)
+	}
+}
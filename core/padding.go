@@ -0,0 +1,108 @@
+package core
+
+import "github.com/shepheb/psec"
+
+// Align pads with a fill value, 0 by default, up to the next multiple of
+// Boundary words: .align n[, fill]
+type Align struct {
+	Boundary Expression
+	Fill     Expression // nil for 0
+	loc      *psec.Loc
+}
+
+// Assemble for Align works out the padding on every pass, since it changes as
+// the code before it does.
+func (a *Align) Assemble(s *AssemblyState) {
+	n := a.Boundary.Evaluate(s)
+	if n == 0 {
+		s.Errorf(a.Boundary.Location(), "can't align to 0")
+		return
+	}
+	pad(s, (n-s.index%n)%n, a.Fill, a.loc)
+}
+
+// PadTo pads with a fill value, 0 by default, up to the given address:
+// .pad_to addr[, fill]
+type PadTo struct {
+	Addr Expression
+	Fill Expression // nil for 0
+	loc  *psec.Loc
+}
+
+// Assemble for PadTo is an error if the code before it has already passed the
+// address.
+func (p *PadTo) Assemble(s *AssemblyState) {
+	addr := p.Addr.Evaluate(s)
+	if addr < s.index {
+		s.Errorf(p.loc, ".pad_to $%04x is behind the current address $%04x", addr, s.index)
+		return
+	}
+	pad(s, addr-s.index, p.Fill, p.loc)
+}
+
+// pad writes n copies of the fill value.
+func pad(s *AssemblyState, n uint32, fill Expression, loc *psec.Loc) {
+	if n > maxIterations {
+		s.Errorf(loc, "padding of %d words is too large", n)
+		return
+	}
+	value := uint16(0)
+	if fill != nil {
+		value = Evaluate16(fill, s)
+	}
+	for i := uint32(0); i < n; i++ {
+		s.Push(value)
+	}
+}
+
+// OrgForward is an .org that can only move forward, leaving a gap: .org_fwd
+// addr. It catches code growing past a fixed address, as .pad_to does, without
+// writing the gap.
+type OrgForward struct {
+	Abs Expression
+	loc *psec.Loc
+}
+
+// Assemble for OrgForward moves the index, like Org, unless it would go
+// backwards.
+func (o *OrgForward) Assemble(s *AssemblyState) {
+	addr := o.Abs.Evaluate(s)
+	if addr < s.index {
+		s.Errorf(o.loc, ".org_fwd $%04x is behind the current address $%04x", addr, s.index)
+		return
+	}
+	s.endSizes()
+	s.index = addr
+	s.wrapped = false
+}
+
+func addPaddingParsers(g *psec.Grammar) {
+	optFill := psec.Optional(psec.SeqAt(3, ws(), lit(","), ws(), sym("expr")))
+	g.WithAction("dir:align",
+		psec.Seq(litIC("align"), sym("ws1"), sym("expr"), optFill),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			rs := r.([]interface{})
+			a := &Align{Boundary: rs[2].(Expression), loc: loc}
+			if fill, ok := rs[3].(Expression); ok {
+				a.Fill = fill
+			}
+			return a, nil
+		})
+	g.WithAction("dir:pad_to",
+		psec.Seq(litIC("pad_to"), sym("ws1"), sym("expr"), optFill),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			rs := r.([]interface{})
+			p := &PadTo{Addr: rs[2].(Expression), loc: loc}
+			if fill, ok := rs[3].(Expression); ok {
+				p.Fill = fill
+			}
+			return p, nil
+		})
+	g.WithAction("dir:org_fwd",
+		psec.SeqAt(2, litIC("org_fwd"), sym("ws1"), sym("expr")),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			return &OrgForward{Abs: r.(Expression), loc: loc}, nil
+		})
+	g.AddSymbol("dir:padding",
+		psec.Alt(sym("dir:align"), sym("dir:pad_to"), sym("dir:org_fwd")))
+}
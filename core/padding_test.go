@@ -0,0 +1,44 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAlign(t *testing.T) {
+	_, res := assembleTest(t, `
+.dat 1, 2, 3
+.align 4
+:table .dat 5
+.align 4, 0xffff
+.align 4
+.dat 6
+.align 1`)
+	expectWords(t, res, 1, 2, 3, 0, 5, 0xffff, 0xffff, 0xffff, 6)
+}
+
+func TestPadTo(t *testing.T) {
+	// The padding depends on a label after it, so it takes a few passes to settle.
+	_, res := assembleTest(t, `
+.dat end - start
+:start .dat 1
+.pad_to 4, 9
+.dat 2
+.org_fwd 6
+.dat 3
+:end`)
+	expectWords(t, res, 6, 1, 9, 9, 2, 0, 3)
+}
+
+func TestPaddingErrors(t *testing.T) {
+	for _, c := range []struct{ src, msg string }{
+		{".align 0", "can't align to 0"},
+		{".dat 1, 2, 3\n.pad_to 2", ".pad_to $0002 is behind the current address $0003"},
+		{".org 8\n.org_fwd 4", ".org_fwd $0004 is behind the current address $0008"},
+	} {
+		_, res := assembleTest(t, c.src)
+		if len(res.Diagnostics) != 1 || !strings.Contains(res.Diagnostics[0].Message, c.msg) {
+			t.Errorf("%q: expected an error with %q, got %v", c.src, c.msg, res.Diagnostics)
+		}
+	}
+}
@@ -6,19 +6,22 @@ import (
 	"github.com/shepheb/psec"
 )
 
-// ReservedWordsFn is the type for ReservedWords
-type ReservedWordsFn func(ident string) bool
+// sourceLine is the parsed content of one line, and where it came from.
+type sourceLine struct {
+	value interface{}
+	loc   *psec.Loc
+}
 
-// ReservedWords should be set by the downstream parsers, defining what
-// identifiers are considered illegal.
-var ReservedWords ReservedWordsFn = func(ident string) bool { return false }
+// ReservedWordsFn is the type for Assembler.SetReservedWords.
+type ReservedWordsFn func(ident string) bool
 
 // AddBasicParsers sets up most of the core structures needed by the assembler's
-// parser.
+// parser. The parser's actions report to the given Assembler, so each Assembler
+// needs its own grammar.
 // The machine-specific parser is only responsible for parsing instructions.
 // Define a symbol "instruction" that parses an instruction (without labels),
 // which returns either Assembled or []Assembled.
-func AddBasicParsers(g *psec.Grammar) {
+func AddBasicParsers(g *psec.Grammar, a *Assembler) {
 	g.AddSymbol("START", sym("file"))
 	g.AddSymbol("ws", psec.ManyDrop(psec.OneOf(" \t\r\n")))
 	g.AddSymbol("ws1", psec.Many1(psec.OneOf(" \t\r")))
@@ -32,28 +35,35 @@ func AddBasicParsers(g *psec.Grammar) {
 			return nil, nil
 		})
 
-	g.AddSymbol("letterish",
-		psec.Alt(psec.OneOf("$_"), psec.Range('a', 'z'), psec.Range('A', 'Z')))
-	g.WithAction("identifier", psec.Seq(sym("letterish"),
+	// $ can't start an identifier, since $FF is a hex literal.
+	g.AddSymbol("identifier start",
+		psec.Alt(psec.OneOf("_"), psec.Range('a', 'z'), psec.Range('A', 'Z')))
+	g.AddSymbol("letterish", psec.Alt(psec.OneOf("$"), sym("identifier start")))
+	g.WithAction("identifier", psec.Seq(sym("identifier start"),
 		psec.Stringify(psec.Many(psec.Alt(psec.Range('0', '9'), sym("letterish"))))),
 		func(r interface{}, loc *psec.Loc) (interface{}, error) {
 			rs := r.([]interface{})
 			s := fmt.Sprintf("%c%s", rs[0].(byte), rs[1].(string))
-			if ReservedWords(s) {
+			if a.reserved(s) {
 				return "", fmt.Errorf("reserved word")
 			}
 			return s, nil
 		})
 
+	// Labels are global, local to the last global label (:.name), or numeric
+	// (:1), referred to as 1f or 1b for the next or previous :1.
+	g.WithAction("local label", psec.SeqAt(1, lit("."), sym("identifier")),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			return "." + r.(string), nil
+		})
+	g.AddSymbol("numeric label", psec.Stringify(psec.Many1(psec.Range('0', '9'))))
 	g.WithAction("label",
-		psec.SeqAt(1, lit(":"), sym("identifier")),
+		psec.SeqAt(1, lit(":"),
+			psec.Alt(sym("identifier"), sym("local label"), sym("numeric label"))),
 		func(r interface{}, loc *psec.Loc) (interface{}, error) {
 			return DefineLabel(r.(string), loc), nil
 		})
 
-	g.AddSymbol("string", psec.SeqAt(1, lit("\""),
-		psec.Stringify(psec.ManyTill(psec.AnyChar(), lit("\"")))))
-
 	g.AddSymbol("content",
 		// This backtracking is probably slow, but I'm not sure how to do better.
 		psec.Alt(sym("comment"), sym("labeled directive"), sym("labeled instruction"), sym("label")))
@@ -95,26 +105,38 @@ func AddBasicParsers(g *psec.Grammar) {
 	g.AddSymbol("amble",
 		psec.Seq(ws(), psec.Many(psec.Seq(sym("comment"), ws()))))
 
+	// Tags each line's content with where it started, for the listing.
+	g.WithAction("line", sym("content"),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			if r == nil {
+				return nil, nil
+			}
+			return &sourceLine{value: r, loc: loc}, nil
+		})
+
 	g.WithAction("file",
-		psec.SeqAt(1, sym("amble"), psec.SepBy(sym("content"), sym("eol")), sym("amble")),
+		psec.SeqAt(1, sym("amble"), psec.SepBy(sym("line"), sym("eol")), sym("amble")),
 		func(r interface{}, loc *psec.Loc) (interface{}, error) {
 			// Comments give nil, the rest give Assembled values.
 			rs := r.([]interface{})
-			var asm []Assembled
+			var lines []Assembled
+			var locs []*psec.Loc
 			for _, val := range rs {
-				if val != nil {
-					if asms, ok := val.([]interface{}); ok {
-						for _, a := range asms {
-							asm = append(asm, a.(Assembled))
+				if line, ok := val.(*sourceLine); ok {
+					if asms, ok := line.value.([]interface{}); ok {
+						for _, asm := range asms {
+							lines = append(lines, asm.(Assembled))
+							locs = append(locs, line.loc)
 						}
 					} else {
-						asm = append(asm, val.(Assembled))
+						lines = append(lines, line.value.(Assembled))
+						locs = append(locs, line.loc)
 					}
 				}
 			}
-			return &AST{Lines: asm}, nil
+			return foldBlocks(lines, locs), nil
 		})
 
 	addExprParsers(g)
-	addDirectiveParsers(g)
+	addDirectiveParsers(g, a)
 }
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/shepheb/psec"
+)
+
+// Region is a contiguous run of written words, for the -map report.
+type Region struct {
+	Start uint32
+	Size  uint32
+	// The line that wrote the first word, or nil if it isn't known.
+	Loc *psec.Loc
+}
+
+// End gives the address of the region's last word.
+func (r Region) End() uint32 { return r.Start + r.Size - 1 }
+
+// regions pairs up the segments of the final image with the lines that started
+// them.
+func (s *AssemblyState) regions(segs []Segment) []Region {
+	var regions []Region
+	for _, seg := range segs {
+		regions = append(regions, Region{Start: seg.Start, Size: uint32(len(seg.Words)),
+			Loc: s.regionStarts[seg.Start]})
+	}
+	return regions
+}
+
+// overlap is a run of words that one line wrote over another's.
+type overlap struct {
+	diag  *Diagnostic
+	line  *Emission
+	prev  *psec.Loc
+	start uint32
+	end   uint32
+}
+
+// overlapped reports that the line e is writing the word at the index, which
+// the line at prev already wrote. Consecutive words from the same pair of lines
+// are reported as one range.
+func (s *AssemblyState) overlapped(e *Emission, prev *psec.Loc) {
+	o := s.overlap
+	if o != nil && e != nil && o.line == e && o.prev == prev && o.end+1 == s.index {
+		o.end = s.index
+		o.diag.Message = overlapMessage(o.start, o.end, prev)
+		return
+	}
+
+	var loc *psec.Loc
+	if e != nil {
+		loc = e.Loc
+	}
+	s.Errorf(loc, "%s", overlapMessage(s.index, s.index, prev))
+	s.overlap = &overlap{diag: s.diags[len(s.diags)-1], line: e, prev: prev,
+		start: s.index, end: s.index}
+}
+
+func overlapMessage(start, end uint32, prev *psec.Loc) string {
+	where := fmt.Sprintf("$%04x", start)
+	if end != start {
+		where = fmt.Sprintf("$%04x-$%04x", start, end)
+	}
+	by := ""
+	if prev != nil {
+		by = fmt.Sprintf(", already written by %s:%d", prev.Filename, prev.Line)
+	}
+	return fmt.Sprintf("overlapping regions at %s%s", where, by)
+}
+
+// OverwriteMode allows or forbids writing over words that have already been
+// written, for deliberately patching code: .overwrite on|off
+// It's off at the start of every pass.
+type OverwriteMode struct {
+	On bool
+}
+
+// Assemble for OverwriteMode sets the mode for the lines after it.
+func (m *OverwriteMode) Assemble(s *AssemblyState) {
+	s.overwrite = m.On
+}
+
+func addRegionParsers(g *psec.Grammar) {
+	g.WithAction("dir:overwrite",
+		psec.SeqAt(2, litIC("overwrite"), sym("ws1"), psec.Alt(litIC("on"), litIC("off"))),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			return &OverwriteMode{On: strings.EqualFold(r.(string), "on")}, nil
+		})
+}
+
+// WriteMap writes a report of the regions, one per line, with their start and
+// end addresses, size in words, and the line that started each one.
+func WriteMap(w io.Writer, regions []Region) error {
+	if _, err := fmt.Fprintf(w, "%-10s %-10s %8s  %s\n", "start", "end", "size", "source"); err != nil {
+		return err
+	}
+	for _, r := range regions {
+		source := "?"
+		if r.Loc != nil {
+			source = fmt.Sprintf("%s:%d", r.Loc.Filename, r.Loc.Line)
+		}
+		_, err := fmt.Fprintf(w, "%-10s %-10s %8d  %s\n", fmt.Sprintf("$%04x", r.Start),
+			fmt.Sprintf("$%04x", r.End()), r.Size, source)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
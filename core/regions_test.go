@@ -0,0 +1,134 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOrgBackwards(t *testing.T) {
+	a := NewAssembler(newTestDriver, Options{Fill: 0xeeee})
+	res, err := a.Assemble(context.Background(), Source{Filename: "test", Text: []byte(`
+.org 4
+.dat 1, 2
+.org 0
+.dat 3
+.dat 4`)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectWords(t, res, 3, 4, 0xeeee, 0xeeee, 1, 2)
+
+	if len(res.Regions) != 2 {
+		t.Fatalf("expected 2 regions, got %v", res.Regions)
+	}
+	var buf bytes.Buffer
+	if err := WriteMap(&buf, res.Regions); err != nil {
+		t.Fatal(err)
+	}
+	expected := "start      end            size  source\n" +
+		"$0000      $0001             2  test:5\n" +
+		"$0004      $0005             2  test:3\n"
+	if buf.String() != expected {
+		t.Errorf("wrong map, expected:\n%sgot:\n%s", expected, buf.String())
+	}
+}
+
+func TestSparseOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "main.asm")
+	if err := ioutil.WriteFile(src, []byte(".dat 0x1234\n.org 0x100\n.dat 0xabcd\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(dir, "out.hex")
+	diags := MasterAssembler(newTestDriver, src, Options{}, Outputs{Binary: out, Format: "ihex", Sparse: true})
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	hex, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ":020000001234B8\n:02020000ABCD84\n:00000001FF\n"
+	if string(hex) != expected {
+		t.Errorf("wrong sparse output, expected:\n%sgot:\n%s", expected, hex)
+	}
+
+	diags = MasterAssembler(newTestDriver, src, Options{}, Outputs{Binary: out, Sparse: true})
+	if len(diags) != 1 || diags[0].Message != "output format 'bin' can't write sparse output" {
+		t.Errorf("expected an error for sparse bin output, got %v", diags)
+	}
+
+	// A dense image that would run to a high address is refused, not built.
+	if err := ioutil.WriteFile(src, []byte(".org 0xffff0000\n.dat 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	diags = MasterAssembler(newTestDriver, src, Options{}, Outputs{Binary: out})
+	if len(diags) != 1 || !strings.Contains(diags[0].Message, "use -sparse") {
+		t.Errorf("expected an error for a huge image, got %v", diags)
+	}
+	diags = MasterAssembler(newTestDriver, src, Options{}, Outputs{Binary: out, Format: "srec", Sparse: true})
+	if len(diags) != 1 || !strings.Contains(diags[0].Message, "too high for byte-addressed records") {
+		t.Errorf("expected an error for a word address past 31 bits, got %v", diags)
+	}
+
+	if err := ioutil.WriteFile(src, []byte(".org 0x10000000\n.dat 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	diags = MasterAssembler(newTestDriver, src, Options{}, Outputs{Binary: out, Format: "srec", Sparse: true})
+	if len(diags) > 0 {
+		t.Errorf("unexpected diagnostics for sparse output: %v", diags)
+	}
+}
+
+func TestOverlaps(t *testing.T) {
+	_, res := assembleTest(t, `
+.org 4
+.dat 1, 2, 3
+.org 2
+.dat 4, 5, 6, 7
+.org 5
+.dat 8`)
+	expected := []string{
+		"overlapping regions at $0004-$0005, already written by test:3",
+		"overlapping regions at $0005, already written by test:5",
+	}
+	ds := res.Diagnostics
+	if len(ds) != 2 || ds[0].Loc.Line != 5 || ds[1].Loc.Line != 7 {
+		t.Fatalf("expected errors on lines 5 and 7, got %v", ds)
+	}
+	for i, msg := range expected {
+		if ds[i].Message != msg {
+			t.Errorf("expected %q, got %q", msg, ds[i].Message)
+		}
+	}
+}
+
+func TestOverwrite(t *testing.T) {
+	_, res := assembleTest(t, `
+.dat 1, 2, 3
+.overwrite on
+.org 1
+.dat 9
+.overwrite off`)
+	expectWords(t, res, 1, 9, 3)
+
+	_, res = assembleTest(t, `
+.dat 1, 2, 3
+.overwrite on
+.overwrite off
+.org 1
+.dat 9`)
+	if len(res.Diagnostics) != 1 || res.Diagnostics[0].Loc.Line != 6 {
+		t.Errorf("expected an overlap on line 6, got %v", res.Diagnostics)
+	}
+}
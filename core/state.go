@@ -1,6 +1,11 @@
 package core
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+
+	"github.com/shepheb/psec"
+)
 
 // labelRef captures the state of a label during assembly. Since it can be a
 // forward reference, it might not have a known value yet. If an expression
@@ -9,6 +14,9 @@ import "fmt"
 type labelRef struct {
 	value   uint32
 	defined bool
+	loc     *psec.Loc // Where it was defined, for the symbol table.
+	size    uint32    // For sizeof, as of the last pass.
+	builtin bool      // Predefined by the machine driver.
 }
 
 // AssemblyState tracks the state of the assembly so far.
@@ -18,11 +26,23 @@ type AssemblyState struct {
 	// These are collected early and added with addLabel(), but their values are
 	// set to null initially.
 	labels map[string]*labelRef
+	// Where each label was defined this pass, to catch one that's defined again
+	// by a .rep or a macro, and the labels the check before assembling already
+	// found defined twice.
+	defined    map[string]*psec.Loc
+	duplicates map[string]bool
+
+	// Constants defined with .equ. Like labels, they're collected early, so they
+	// can be used before they're defined, and they can't be changed. Where each
+	// was defined this pass is kept to report a different value.
+	constants map[string]*labelRef
+	equated   map[string]*psec.Loc
 
 	// Updateable defines.
 	symbols map[string]*labelRef
 
-	macros map[string]string
+	// The Assembler running this assembly, for its driver and macros.
+	asm *Assembler
 
 	// True when all labels are resolved, false otherwise.
 	resolved bool
@@ -30,13 +50,63 @@ type AssemblyState struct {
 	dirty       bool
 	dirtyLabels []string
 
-	rom   [16 * 1024 * 1024]uint16
+	// Macro expansions so far this pass, for \@ and .local.
+	expansions int
+
+	// The last global label, which owns local labels like .loop.
+	scope string
+	// How many of each numeric label have been defined so far this pass.
+	numbered map[string]int
+
+	// The last global and local labels, whose sizes are being measured for
+	// sizeof, and the index just past the last word pushed.
+	sizingGlobal *labelRef
+	sizingLocal  *labelRef
+	dataEnd      uint32
+
+	// The charmaps defined so far this pass, and the active one.
+	charmaps map[string]*charmap
+	charmap  *charmap
+
+	mem   *Memory
 	index uint32
-	used  map[uint32]bool
+	// The line that wrote the first word of each region, by its address.
+	regionStarts map[uint32]*psec.Loc
+	// The line that wrote each word, for overlap errors, and the latest
+	// overlap, which grows into a range as a line keeps overlapping.
+	writers map[uint32]*psec.Loc
+	overlap *overlap
+	// Set by .overwrite on, to allow patching words already written.
+	overwrite bool
+	// Set when a word is written at $ffffffff, so there's no room for another
+	// until the next .org, and once that's been reported this pass.
+	wrapped      bool
+	wrapReported bool
+
+	// The files parsed, and those with .once, before assembling. Macro
+	// expansions are parsed again on every pass, so the files they include are
+	// forgotten at the start of each one, or .include_once would skip them.
+	parsedBefore map[string]bool
+	onceBefore   map[string]bool
+
+	// Errors and warnings from the current pass. Only the final pass's are
+	// reported, since earlier passes can see labels that haven't settled yet.
+	diags Diagnostics
+	// Errors and warnings from checking the source before assembling it.
+	checks Diagnostics
+
+	// What each line emitted this pass, and the lines currently being
+	// assembled, innermost last.
+	listing   []*Emission
+	lineStack []*Emission
 }
 
 func (s *AssemblyState) lookup(key string) (uint32, bool, bool) {
-	if lr, ok := s.labels[key]; ok {
+	// Only labels are local; constants and symbols starting with '_' aren't.
+	if lr, ok := s.labels[s.labelKey(key)]; ok {
+		return lr.value, lr.defined, true
+	}
+	if lr, ok := s.constants[key]; ok {
 		return lr.value, lr.defined, true
 	}
 	if lr, ok := s.symbols[key]; ok {
@@ -45,9 +115,83 @@ func (s *AssemblyState) lookup(key string) (uint32, bool, bool) {
 	return 0, false, false
 }
 
-func (s *AssemblyState) addLabel(l string) {
+// isDefined is true for a label, constant or symbol that's been given a value
+// so far this pass, for .ifdef and defined(). Values from earlier passes don't
+// count, or an .ifndef guarding a label or .equ would skip it on the next pass.
+func (s *AssemblyState) isDefined(key string) bool {
+	name := s.labelKey(key)
+	if _, ok := s.labels[name]; ok {
+		_, ok := s.defined[name]
+		return ok
+	}
+	if _, ok := s.constants[key]; ok {
+		_, ok := s.equated[key]
+		return ok
+	}
+	lr, ok := s.symbols[key]
+	return ok && lr.defined
+}
+
+// qualify gives the full name of a label: local labels, starting with '.' or
+// '_', belong to the last global label. .name under main is main.name, and
+// _name is main._name. Before the first global label, _name is left as it is.
+func (s *AssemblyState) qualify(name string) string {
+	switch {
+	case strings.HasPrefix(name, "."):
+		return s.scope + name
+	case strings.HasPrefix(name, "_") && s.scope != "":
+		return s.scope + "." + name
+	}
+	return name
+}
+
+// labelKey gives the name a label reference is stored under. That's its full
+// name, unless it's a _name defined before the first global label, which is
+// global, like :_start at the top of a file.
+func (s *AssemblyState) labelKey(name string) string {
+	full := s.qualify(name)
+	if _, ok := s.labels[full]; !ok {
+		if _, ok := s.labels[name]; ok && strings.HasPrefix(name, "_") {
+			return name
+		}
+	}
+	return full
+}
+
+// isLocalLabel is true for labels that belong to the last global label.
+func isLocalLabel(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")
+}
+
+// labelName gives the full name for a label being defined, in order: global
+// labels start a new scope for local ones, and each numeric label is numbered by
+// how many came before it.
+func (s *AssemblyState) labelName(label string) string {
+	switch {
+	case isNumericLabel(label):
+		s.numbered[label]++
+		return numberedName(label, s.numbered[label])
+	case isLocalLabel(label):
+		return s.qualify(label)
+	}
+	s.scope = label
+	return label
+}
+
+// isNumericLabel is true for numeric labels, and the names they're stored
+// under. Nothing else starts with a digit.
+func isNumericLabel(name string) bool {
+	return name != "" && '0' <= name[0] && name[0] <= '9'
+}
+
+// numberedName gives the name the nth numeric label is stored under.
+func numberedName(label string, n int) string {
+	return fmt.Sprintf("%s~%d", label, n)
+}
+
+func (s *AssemblyState) addLabel(l string, loc *psec.Loc) {
 	if _, ok := s.labels[l]; !ok {
-		s.labels[l] = &labelRef{0, false}
+		s.labels[l] = &labelRef{loc: loc}
 	}
 }
 
@@ -64,17 +208,111 @@ func (s *AssemblyState) updateLabel(l string, loc uint32) {
 	}
 }
 
-func (s *AssemblyState) updateSymbol(l string, val uint32) {
-	s.symbols[l] = &labelRef{val, true}
+// measure starts measuring the size of a label that was just defined, which
+// ends the measurement of the last label at the same level: a global label ends
+// both the last global and local ones, and a local label ends the last local
+// one. Numeric labels aren't measured.
+func (s *AssemblyState) measure(label string, lr *labelRef) {
+	switch {
+	case isNumericLabel(label):
+	case isLocalLabel(label):
+		s.endSize(&s.sizingLocal)
+		s.sizingLocal = lr
+	default:
+		s.endSizes()
+		s.sizingGlobal = lr
+	}
+}
+
+// endSizes ends the measurement of all labels, at an .org or the end of a pass.
+func (s *AssemblyState) endSizes() {
+	s.endSize(&s.sizingLocal)
+	s.endSize(&s.sizingGlobal)
+}
+
+func (s *AssemblyState) endSize(open **labelRef) {
+	lr := *open
+	if lr == nil {
+		return
+	}
+	*open = nil
+
+	size := uint32(0)
+	if s.dataEnd > lr.value {
+		size = s.dataEnd - lr.value
+	}
+	if size != lr.size {
+		// Anything using sizeof() needs another pass.
+		lr.size = size
+		s.dirty = true
+	}
+}
+
+func (s *AssemblyState) addConstant(name string, loc *psec.Loc) {
+	if _, ok := s.constants[name]; !ok {
+		s.constants[name] = &labelRef{loc: loc}
+	}
+}
+
+// updateConstant sets an .equ constant's value, which is an error if it was
+// already given a different one this pass.
+func (s *AssemblyState) updateConstant(name string, value uint32, loc *psec.Loc) {
+	s.addConstant(name, loc)
+	cr := s.constants[name]
+	if prev, ok := s.equated[name]; ok {
+		if cr.value != value {
+			s.Errorf(loc, "Constant '%s' is already defined as %d at %s:%d",
+				name, cr.value, prev.Filename, prev.Line)
+		}
+		return
+	}
+	s.equated[name] = loc
+	if !cr.defined || cr.value != value {
+		s.dirty = true
+	}
+	cr.value = value
+	cr.defined = true
+	cr.loc = loc
+}
+
+func (s *AssemblyState) updateSymbol(l string, val uint32, loc *psec.Loc) {
+	s.symbols[l] = &labelRef{value: val, defined: true, loc: loc}
 }
 
 func (s *AssemblyState) reset() {
 	s.symbols = make(map[string]*labelRef)
+	for name, value := range s.asm.predefined {
+		s.symbols[name] = &labelRef{value: value, defined: true, builtin: true}
+	}
+	for name, value := range s.asm.Options.Defines {
+		s.symbols[name] = &labelRef{value: value, defined: true}
+	}
+	s.asm.parsed = copyFlags(s.parsedBefore)
+	s.asm.once = copyFlags(s.onceBefore)
 	s.resolved = true
 	s.dirty = false
 	s.dirtyLabels = nil
+	s.expansions = 0
+	s.scope = ""
+	s.numbered = map[string]int{}
+	s.defined = map[string]*psec.Loc{}
+	s.equated = map[string]*psec.Loc{}
+	s.sizingGlobal = nil
+	s.sizingLocal = nil
+	s.dataEnd = 0
+	s.charmap = newCharmap(defaultCharmap)
+	s.charmaps = map[string]*charmap{defaultCharmap: s.charmap}
 	s.index = 0
-	s.used = make(map[uint32]bool)
+	s.mem = NewMemory()
+	s.regionStarts = map[uint32]*psec.Loc{}
+	s.writers = map[uint32]*psec.Loc{}
+	s.overlap = nil
+	s.overwrite = false
+	s.wrapped = false
+	s.wrapReported = false
+	s.diags = nil
+	s.listing = nil
+	s.lineStack = nil
 }
 
 // Index gives the address of the next instruction to assemble.
@@ -87,18 +325,39 @@ func (s *AssemblyState) Index() uint32 {
 // exported because machine-specific code needs to push their encoded values to
 // it.
 func (s *AssemblyState) Push(x uint16) {
-	if s.used[s.index] {
-		panic(fmt.Sprintf("overlapping regions at $%04x", s.index))
+	var e *Emission
+	var loc *psec.Loc
+	if n := len(s.lineStack); n > 0 {
+		e = s.lineStack[n-1]
+		loc = e.Loc
+	}
+	if s.wrapped {
+		if !s.wrapReported {
+			s.Errorf(loc, "the address wrapped past $ffffffff")
+			s.wrapReported = true
+		}
+		return
+	}
+
+	startsRegion := s.index == 0 || !s.mem.Written(s.index-1)
+	if s.mem.Write(s.index, x) && !s.overwrite {
+		s.overlapped(e, s.writers[s.index])
+	}
+	s.writers[s.index] = loc
+	if e != nil {
+		if _, ok := s.regionStarts[s.index]; startsRegion && !ok {
+			s.regionStarts[s.index] = e.Loc
+		}
+		if len(e.Words) == 0 {
+			e.Address = s.index
+		}
+		e.Words = append(e.Words, x)
 	}
-	s.used[s.index] = true
-	s.rom[s.index] = x
 	s.index++
+	s.dataEnd = s.index
+	s.wrapped = s.index == 0
 }
 
 func (s *AssemblyState) MarkDirty() {
 	s.dirty = true
 }
-
-func (s *AssemblyState) addMacro(name, body string) {
-
-}
@@ -0,0 +1,141 @@
+package core
+
+import (
+	"fmt"
+
+	"github.com/shepheb/psec"
+)
+
+// stringLayout is how a string directive lays out its characters in words.
+type stringLayout int
+
+const (
+	layoutZero     stringLayout = iota // .asciiz: one per word, then a 0 word.
+	layoutLength                       // .pstring: the length, then one per word.
+	layoutPacked                       // .packed: two per word, the first in the high byte.
+	layoutPackedLE                     // .packed_le: two per word, the first in the low byte.
+)
+
+// StringBlock is a string directive, which writes its strings in one of the
+// layouts above. Each string is laid out separately, so .asciiz "a", "b" writes
+// two 0s.
+type StringBlock struct {
+	Layout  stringLayout
+	Strings []string
+	loc     *psec.Loc
+}
+
+// Assemble for StringBlock writes each string, through the active charmap.
+func (b *StringBlock) Assemble(s *AssemblyState) {
+	limit := uint32(0xffff)
+	if b.Layout == layoutPacked || b.Layout == layoutPackedLE {
+		limit = 0xff
+	}
+
+	for _, str := range b.Strings {
+		var codes []uint16
+		for _, c := range str {
+			code := s.MapChar(c, b.loc)
+			if code > limit {
+				s.Errorf(b.loc, "Character %U in %q doesn't fit in %d bits", c, str,
+					bitsFor(limit))
+				return
+			}
+			codes = append(codes, uint16(code))
+		}
+
+		switch b.Layout {
+		case layoutZero:
+			pushCodes(s, codes)
+			s.Push(0)
+		case layoutLength:
+			if len(codes) > 0xffff {
+				s.Errorf(b.loc, "String is too long for .pstring: %d characters", len(codes))
+				return
+			}
+			s.Push(uint16(len(codes)))
+			pushCodes(s, codes)
+		case layoutPacked, layoutPackedLE:
+			// An odd character out gets a 0 in the other byte.
+			for i := 0; i < len(codes); i += 2 {
+				first, second := codes[i], uint16(0)
+				if i+1 < len(codes) {
+					second = codes[i+1]
+				}
+				if b.Layout == layoutPacked {
+					s.Push(first<<8 | second)
+				} else {
+					s.Push(second<<8 | first)
+				}
+			}
+		}
+	}
+}
+
+func pushCodes(s *AssemblyState, codes []uint16) {
+	for _, c := range codes {
+		s.Push(c)
+	}
+}
+
+func bitsFor(limit uint32) int {
+	if limit == 0xff {
+		return 8
+	}
+	return 16
+}
+
+// stringChars turns a string in .dat into a Char for each character, so they're
+// checked like the other values.
+func stringChars(str string, loc *psec.Loc) []Expression {
+	var values []Expression
+	for _, c := range str {
+		values = append(values, &Char{Value: c, Loc: loc})
+	}
+	return values
+}
+
+func addStringParsers(g *psec.Grammar) {
+	// "text", with the same escapes as character literals. A literal newline
+	// isn't allowed, use \n.
+	g.WithAction("string",
+		psec.SeqAt(1, lit("\""),
+			psec.Stringify(psec.Many(psec.Alt(psec.Seq(lit("\\"), psec.NoneOf("\n")),
+				psec.NoneOf("\"\\\n")))),
+			lit("\"")),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			chars, err := Unescape(r.(string))
+			if err != nil {
+				return nil, fmt.Errorf("bad string \"%s\": %v", r, err)
+			}
+			return string(chars), nil
+		})
+
+	layouts := []struct {
+		name   string
+		layout stringLayout
+	}{
+		// packed_le must come before its prefix, packed.
+		{"asciiz", layoutZero},
+		{"pstring", layoutLength},
+		{"packed_le", layoutPackedLE},
+		{"packed", layoutPacked},
+	}
+	var dirs []psec.Parser
+	for _, l := range layouts {
+		layout := l.layout
+		name := "dir:" + l.name
+		g.WithAction(name,
+			psec.SeqAt(2, litIC(l.name), sym("ws1"),
+				psec.SepBy(sym("string"), psec.Seq(ws(), lit(","), ws()))),
+			func(r interface{}, loc *psec.Loc) (interface{}, error) {
+				b := &StringBlock{Layout: layout, loc: loc}
+				for _, str := range r.([]interface{}) {
+					b.Strings = append(b.Strings, str.(string))
+				}
+				return b, nil
+			})
+		dirs = append(dirs, sym(name))
+	}
+	g.AddSymbol("dir:strings", psec.Alt(dirs...))
+}
@@ -0,0 +1,40 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStringEscapes(t *testing.T) {
+	_, res := assembleTest(t, `.dat "a\"b\n\0\x7f\\", 'c'`)
+	expectWords(t, res, 'a', '"', 'b', '\n', 0, 0x7f, '\\', 'c')
+
+	_, res = assembleTest(t, `.dat "☃;"  ; a snowman`)
+	expectWords(t, res, 0x2603, ';')
+}
+
+func TestStringLayouts(t *testing.T) {
+	_, res := assembleTest(t, `
+.asciiz "hi", ""
+.pstring "abc"
+.packed "abc"
+.packed_le "abcd"`)
+	expectWords(t, res,
+		'h', 'i', 0, 0,
+		3, 'a', 'b', 'c',
+		0x6162, 0x6300,
+		0x6261, 0x6463)
+}
+
+func TestStringErrors(t *testing.T) {
+	for _, c := range []struct{ src, msg string }{
+		{`.dat "😀"`, "doesn't fit in a single word"},
+		{`.asciiz "😀"`, "doesn't fit in 16 bits"},
+		{`.packed "Ā"`, "doesn't fit in 8 bits"},
+	} {
+		_, res := assembleTest(t, c.src)
+		if len(res.Diagnostics) != 1 || !strings.Contains(res.Diagnostics[0].Message, c.msg) {
+			t.Errorf("%s: expected an error with %q, got %v", c.src, c.msg, res.Diagnostics)
+		}
+	}
+}
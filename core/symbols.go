@@ -0,0 +1,85 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// SymbolKind says whether a Symbol is a label, an .equ constant or a .define.
+type SymbolKind string
+
+// SymbolKind values
+const (
+	KindLabel    SymbolKind = "label"
+	KindConstant SymbolKind = "constant"
+	KindSymbol   SymbolKind = "symbol"
+)
+
+// Symbol is a label or .define symbol with its final value and where it was
+// defined, for debuggers and emulators.
+type Symbol struct {
+	Name  string     `json:"name"`
+	Value uint32     `json:"value"`
+	Kind  SymbolKind `json:"kind"`
+	File  string     `json:"file,omitempty"`
+	Line  int        `json:"line,omitempty"`
+}
+
+// symbolTable gathers the final labels and symbols, sorted by value and then
+// by name. Local labels have their full names, like main.loop. Numeric labels
+// are left out, since they have no names to look up, as are the machine's
+// predefined symbols.
+func (s *AssemblyState) symbolTable() []Symbol {
+	var syms []Symbol
+	add := func(refs map[string]*labelRef, kind SymbolKind) {
+		for name, ref := range refs {
+			if !ref.defined || ref.builtin || isNumericLabel(name) {
+				continue
+			}
+			sym := Symbol{Name: name, Value: ref.value, Kind: kind}
+			if ref.loc != nil {
+				sym.File = ref.loc.Filename
+				sym.Line = ref.loc.Line
+			}
+			syms = append(syms, sym)
+		}
+	}
+	add(s.labels, KindLabel)
+	add(s.constants, KindConstant)
+	add(s.symbols, KindSymbol)
+
+	sort.Slice(syms, func(i, j int) bool {
+		if syms[i].Value != syms[j].Value {
+			return syms[i].Value < syms[j].Value
+		}
+		return syms[i].Name < syms[j].Name
+	})
+	return syms
+}
+
+// SymbolFormats are the formats WriteSymbols supports.
+var SymbolFormats = []string{"map", "json"}
+
+// WriteSymbols writes the symbol table in the named format: "map" writes one
+// "name address" pair per line, and "json" writes an array of Symbol objects.
+func WriteSymbols(w io.Writer, syms []Symbol, format string) error {
+	switch format {
+	case "map":
+		for _, sym := range syms {
+			if _, err := fmt.Fprintf(w, "%s 0x%04x\n", sym.Name, sym.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "json":
+		if syms == nil {
+			syms = []Symbol{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(syms)
+	}
+	return fmt.Errorf("unknown symbol format '%s'", format)
+}
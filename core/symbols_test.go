@@ -0,0 +1,106 @@
+package core
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSymbolTable(t *testing.T) {
+	_, res := assembleTest(t, `
+:start .dat 1, 2
+.def size, 8
+.org 0x100
+:table .dat size`)
+	if len(res.Diagnostics) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", res.Diagnostics)
+	}
+
+	expected := []Symbol{
+		{Name: "start", Value: 0, Kind: KindLabel, File: "test", Line: 2},
+		{Name: "size", Value: 8, Kind: KindSymbol, File: "test", Line: 3},
+		{Name: "table", Value: 0x100, Kind: KindLabel, File: "test", Line: 5},
+	}
+	if len(res.Symbols) != len(expected) {
+		t.Fatalf("expected %d symbols, got %v", len(expected), res.Symbols)
+	}
+	for i, sym := range expected {
+		if res.Symbols[i] != sym {
+			t.Errorf("expected symbol %d to be %+v, got %+v", i, sym, res.Symbols[i])
+		}
+	}
+
+	var sb strings.Builder
+	if err := WriteSymbols(&sb, res.Symbols, "map"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sb.String() != "start 0x0000\nsize 0x0008\ntable 0x0100\n" {
+		t.Errorf("wrong map output:\n%s", sb.String())
+	}
+
+	sb.Reset()
+	if err := WriteSymbols(&sb, res.Symbols, "json"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var decoded []Symbol
+	if err := json.Unmarshal([]byte(sb.String()), &decoded); err != nil {
+		t.Fatalf("bad JSON output: %v\n%s", err, sb.String())
+	}
+	if len(decoded) != 3 || decoded[2] != expected[2] {
+		t.Errorf("wrong JSON output:\n%s", sb.String())
+	}
+
+	if err := WriteSymbols(&sb, res.Symbols, "elf"); err == nil {
+		t.Errorf("expected an error for an unknown format")
+	}
+}
+
+func TestEquConstants(t *testing.T) {
+	// .equ constants can be used before they're defined, even through another.
+	_, res := assembleTest(t, `
+.dat size, words
+.equ words, size * 2
+.equ size, 3
+.equ size, 3
+.set count, 1
+.dat count
+.set count, count + 1
+.dat count`)
+	expectWords(t, res, 3, 6, 1, 2)
+
+	found := false
+	for _, sym := range res.Symbols {
+		if sym.Name == "size" {
+			found = sym.Kind == KindConstant && sym.Value == 3
+		}
+	}
+	if !found {
+		t.Errorf("expected size to be a constant, got %v", res.Symbols)
+	}
+
+	for _, c := range []struct{ src, msg string }{
+		{".equ size, 3\n.equ size, 4", "Constant 'size' is already defined as 3 at test:1"},
+		{".for i, 0, 2\n.equ n, i\n.endfor", "Constant 'n' is already defined as 0 at test:2"},
+		// .set is still sequential.
+		{".dat count\n.set count, 1", "Unknown label 'count'"},
+		{".equ Z, 1\n.define Z, 2\n.dat Z", "'Z' is a constant defined with .equ at test:1, and can't be redefined"},
+		{".equ Z, 1\n.set Z, 2\n.dat Z", "'Z' is a constant defined with .equ at test:1, and can't be redefined"},
+	} {
+		_, res := assembleTest(t, c.src)
+		if len(res.Diagnostics) != 1 || res.Diagnostics[0].Message != c.msg {
+			t.Errorf("%q: expected an error %q, got %v", c.src, c.msg, res.Diagnostics)
+		}
+	}
+}
+
+func TestEquIncludeGuard(t *testing.T) {
+	// The .equ is known from the first pass on, but the guard only sees it
+	// once it's been assembled this pass.
+	guarded := `
+.ifndef FOO
+.equ FOO, 1
+.dat 7
+.endif`
+	_, res := assembleTest(t, guarded+guarded+"\n.dat defined(FOO)")
+	expectWords(t, res, 7, 1)
+}
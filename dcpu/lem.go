@@ -0,0 +1,146 @@
+package dcpu
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/shepheb/drasm/core"
+	"github.com/shepheb/psec"
+)
+
+// lemColours are the LEM1802's default palette, which are predefined as symbols
+// for .lemstr.
+var lemColours = []string{
+	"black", "blue", "green", "cyan", "red", "magenta", "brown", "light_gray",
+	"dark_gray", "light_blue", "light_green", "light_cyan", "light_red",
+	"light_magenta", "yellow", "white",
+}
+
+// lemChar is a character in a .lemstr, with the colours set by a \c escape
+// before it, or -1 to use the directive's.
+type lemChar struct {
+	char  rune
+	fg    int
+	bg    int
+	blink bool
+}
+
+// lemString writes a string for the LEM1802 display: each word has the
+// foreground colour in its top 4 bits, then the background colour, the blink
+// bit, and the 7-bit character from the active charmap. .lemstr fg, bg, "text"
+type lemString struct {
+	fg    core.Expression
+	bg    core.Expression
+	chars []lemChar
+	loc   *psec.Loc
+}
+
+func (l *lemString) Assemble(s *core.AssemblyState) {
+	fg := l.colour(s, l.fg)
+	bg := l.colour(s, l.bg)
+	for _, c := range l.chars {
+		code := s.MapChar(c.char, l.loc)
+		if code > 0x7f {
+			s.Errorf(l.loc, "Character %U doesn't fit in the LEM1802's 7 bits", c.char)
+			return
+		}
+		word := uint16(code)
+		if c.blink {
+			word |= 0x80
+		}
+		if c.fg >= 0 {
+			word |= uint16(c.fg)<<12 | uint16(c.bg)<<8
+		} else {
+			word |= fg<<12 | bg<<8
+		}
+		s.Push(word)
+	}
+}
+
+func (l *lemString) colour(s *core.AssemblyState, expr core.Expression) uint16 {
+	c := expr.Evaluate(s)
+	if c > 15 {
+		s.Errorf(expr.Location(), "LEM1802 colour must be 0-15, not %d", c)
+		return 0
+	}
+	return uint16(c)
+}
+
+// parseLemText decodes the text of a .lemstr. On top of the usual escapes, \cFB
+// sets the foreground and background colours to the hex digits F and B for the
+// rest of the string, and \k toggles blinking.
+func parseLemText(text string) ([]lemChar, error) {
+	var chars []lemChar
+	fg, bg, blink := -1, -1, false
+	plain := func(upto int) error {
+		runes, err := core.Unescape(text[:upto])
+		if err != nil {
+			return err
+		}
+		for _, r := range runes {
+			chars = append(chars, lemChar{char: r, fg: fg, bg: bg, blink: blink})
+		}
+		text = text[upto:]
+		return nil
+	}
+
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\\' || i+1 >= len(text) {
+			continue
+		}
+		switch text[i+1] {
+		case 'c':
+			if err := plain(i); err != nil {
+				return nil, err
+			}
+			if len(text) < 4 {
+				return nil, fmt.Errorf("\\c needs two hex digits")
+			}
+			colours, err := strconv.ParseUint(text[2:4], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("\\c needs two hex digits, not %q", text[2:4])
+			}
+			fg, bg = int(colours>>4), int(colours&0xf)
+			text = text[4:]
+			i = -1
+		case 'k':
+			if err := plain(i); err != nil {
+				return nil, err
+			}
+			blink = !blink
+			text = text[2:]
+			i = -1
+		default:
+			// Skip the escaped character, so \\c isn't a colour.
+			i++
+		}
+	}
+	if err := plain(len(text)); err != nil {
+		return nil, err
+	}
+	return chars, nil
+}
+
+func addLemParsers(g *psec.Grammar, a *core.Assembler) {
+	for i, name := range lemColours {
+		a.Predefine(name, uint32(i))
+	}
+
+	argSep := psec.Seq(ws(), lit(","), ws())
+	g.WithAction("lemstr",
+		psec.Seq(lit("."), litIC("lemstr"), sym("ws1"), sym("expr"), argSep, sym("expr"),
+			argSep, lit("\""),
+			psec.Stringify(psec.Many(psec.Alt(psec.Seq(lit("\\"), psec.NoneOf("\n")),
+				psec.NoneOf("\"\\\n")))),
+			lit("\"")),
+		func(r interface{}, loc *psec.Loc) (interface{}, error) {
+			rs := r.([]interface{})
+			text := rs[8].(string)
+			chars, err := parseLemText(text)
+			if err != nil {
+				return nil, fmt.Errorf("bad .lemstr text \"%s\": %v", text, err)
+			}
+			return &lemString{fg: rs[3].(core.Expression), bg: rs[5].(core.Expression),
+				chars: chars, loc: loc}, nil
+		})
+}
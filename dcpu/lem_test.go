@@ -0,0 +1,56 @@
+package dcpu
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/shepheb/drasm/core"
+)
+
+func assembleLem(t *testing.T, input string) *core.Result {
+	a := core.NewAssembler(NewDriver, core.Options{})
+	res, err := a.Assemble(context.Background(), core.Source{Filename: "test", Text: []byte(input)})
+	if res == nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return res
+}
+
+func TestLemString(t *testing.T) {
+	res := assembleLem(t, `
+:msg .lemstr white, blue, "Hi\cE0!\k?\\c"
+.lemstr 2, black, "\n"`)
+	if len(res.Diagnostics) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", res.Diagnostics)
+	}
+	expected := []uint16{0xf148, 0xf169, 0xe021, 0xe0bf, 0xe0dc, 0xe0e3, 0x200a}
+	rom := res.ROM()
+	if len(rom) != len(expected) {
+		t.Fatalf("expected %04x, got %04x", expected, rom)
+	}
+	for i, w := range expected {
+		if rom[i] != w {
+			t.Errorf("expected word %d to be %04x, got %04x", i, w, rom[i])
+		}
+	}
+
+	// The colour names aren't in the symbol table.
+	for _, sym := range res.Symbols {
+		if sym.Name != "msg" {
+			t.Errorf("unexpected symbol %s", sym.Name)
+		}
+	}
+}
+
+func TestLemStringErrors(t *testing.T) {
+	for _, c := range []struct{ src, msg string }{
+		{`.lemstr 16, 0, "a"`, "colour must be 0-15"},
+		{`.lemstr 0, 0, "é"`, "doesn't fit in the LEM1802's 7 bits"},
+	} {
+		res := assembleLem(t, c.src)
+		if len(res.Diagnostics) != 1 || !strings.Contains(res.Diagnostics[0].Message, c.msg) {
+			t.Errorf("%s: expected an error with %q, got %v", c.src, c.msg, res.Diagnostics)
+		}
+	}
+}
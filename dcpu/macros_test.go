@@ -7,18 +7,18 @@ import (
 )
 
 func TestBasicMacros(t *testing.T) {
-	core.FreshMacros()
 	input := `
 .macro foo=set a, b
 foo
 foo
 foo`
-	ast, err := dp.ParseString("test", input)
+	a := core.NewAssembler(NewDriver, core.Options{})
+	ast, err := a.Driver().ParseString("test", input)
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
 	}
 
-	ls := ast.(*core.AST).Lines
+	ls := ast.Lines
 	if _, ok := ls[0].(*core.MacroDef); !ok {
 		t.Errorf("Expected the first output to be a MacroDef, got %T", ls[0])
 	}
@@ -29,7 +29,11 @@ foo`
 	}
 
 	// The more interesting test is that it assembles properly.
-	rom := core.AssembleAst(ast.(*core.AST))
+	res := a.AssembleAst(ast)
+	rom, diags := res.ROM(), res.Diagnostics
+	if len(diags) > 0 {
+		t.Errorf("unexpected diagnostics %v", diags)
+	}
 	if len(rom) != 3 {
 		t.Errorf("rom should be length 3, got %d", len(rom))
 		return
@@ -57,12 +61,17 @@ do_num
 do_num`
 	// That should expand to effectively dat num0, num1, num2, and leave
 	// num_counter set to 3.
-	ast, err := dp.ParseString("test", input)
+	a := core.NewAssembler(NewDriver, core.Options{})
+	ast, err := a.Driver().ParseString("test", input)
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
 	}
 
-	rom := core.AssembleAst(ast.(*core.AST))
+	res := a.AssembleAst(ast)
+	rom, diags := res.ROM(), res.Diagnostics
+	if len(diags) > 0 {
+		t.Errorf("unexpected diagnostics %v", diags)
+	}
 	if len(rom) != 3 {
 		t.Errorf("rom should be length 3, got %d", len(rom))
 		return
@@ -62,16 +62,18 @@ func reservedWords(s string) bool {
 
 var keywords = []string{"push", "pop", "peek", "pick", "pc", "ex", "sp"}
 
-func buildDcpuParser() *psec.Grammar {
+func buildDcpuParser(a *core.Assembler) *psec.Grammar {
 	g := psec.NewGrammar()
-	core.AddBasicParsers(g) // Adds ws, identifiers, etc.
+	core.AddBasicParsers(g, a) // Adds ws, identifiers, etc.
 
-	core.ReservedWords = reservedWords
+	a.SetReservedWords(reservedWords)
 	addArgParsers(g)
 	addBinaryOpParsers(g)
 	addUnaryOpParsers(g)
+	addLemParsers(g, a)
 	g.AddSymbol("instruction",
-		psec.Alt(sym("binary instruction"), sym("unary instruction"), sym("macro use")))
+		psec.Alt(sym("binary instruction"), sym("unary instruction"), sym("lemstr"),
+			sym("macro use")))
 
 	return g
 }
@@ -132,9 +134,9 @@ func addArgParsers(g *psec.Grammar) {
 			op := rs[4].(core.Operator)
 			index := rs[6].(core.Expression)
 
-			if op == core.NOT {
-				// Not actually legal to use ~, I'm just abusing the unaryOp for + and -
-				return nil, fmt.Errorf("expected + or -, or ], not ~")
+			if op != core.PLUS && op != core.MINUS {
+				// Not actually legal to use ~ or !, I'm just abusing the unaryOp for + and -
+				return nil, fmt.Errorf("expected + or -, or ], not %s", op)
 			}
 
 			if op == core.MINUS {
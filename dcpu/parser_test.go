@@ -9,8 +9,7 @@ import (
 )
 
 func setup() *psec.Grammar {
-	core.SetDriver(&Driver{})
-	return buildDcpuParser()
+	return core.NewAssembler(NewDriver, core.Options{}).Driver().(*Driver).g
 }
 
 var dp = setup()
@@ -98,6 +97,10 @@ func TestLiteral(t *testing.T) {
 
 	expectExpr(t, dp, "literal", "0x7", &core.Constant{Value: 7})
 	expectExpr(t, dp, "literal", "0xbeef", &core.Constant{Value: 0xbeef})
+	expectExpr(t, dp, "literal", "$beef", &core.Constant{Value: 0xbeef})
+	expectExpr(t, dp, "literal", "0b1010_0101", &core.Constant{Value: 0xa5})
+	expectExpr(t, dp, "literal", "0o17", &core.Constant{Value: 15})
+	expectExpr(t, dp, "literal", "1_000", &core.Constant{Value: 1000})
 }
 
 func loc(line, col int) *psec.Loc {
@@ -181,6 +184,7 @@ func TestRegIndex(t *testing.T) {
 		&arg{reg: 7, indirect: true, offset: e2})
 
 	expectError(t, dp, "[reg+index]", "[b ~3]", "expected + or -, or ], not ~")
+	expectError(t, dp, "[reg+index]", "[b !3]", "expected + or -, or ], not !")
 }
 
 func TestPick(t *testing.T) {
@@ -429,3 +433,32 @@ set pc, pop`
 	// Item 8: set pc, pop
 	compareBinOp(t, ast.Lines[8], 1, &arg{special: 0x1c}, &arg{special: 0x18})
 }
+
+func TestDiagnostics(t *testing.T) {
+	input := `
+set a, missing
+.dat 0x12345
+set b, 1`
+	a := core.NewAssembler(NewDriver, core.Options{})
+	ast, err := a.Driver().ParseString("test", input)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// Both bad lines should be reported, and assembly should carry on past them.
+	res := a.AssembleAst(ast)
+	rom, diags := res.ROM(), res.Diagnostics
+	if len(diags) != 2 {
+		t.Fatalf("expected 2 diagnostics, got %v", diags)
+	}
+	if d := diags[0]; d.Severity != core.SeverityError || d.Loc.Line != 2 ||
+		d.Loc.Col != 7 || d.Message != "Unknown label 'missing'" {
+		t.Errorf("wrong diagnostic for the unknown label: %v", d)
+	}
+	if d := diags[1]; d.Severity != core.SeverityError || d.Loc.Line != 3 {
+		t.Errorf("wrong diagnostic for the oversized dat: %v", d)
+	}
+	if len(rom) != 2 || rom[1] != 0x8821 {
+		t.Errorf("expected assembly to continue to set b, 1; got %04x", rom)
+	}
+}
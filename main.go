@@ -3,6 +3,9 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
+	"strconv"
+	"strings"
 
 	"github.com/shepheb/drasm/core"
 	"github.com/shepheb/drasm/dcpu"
@@ -11,7 +14,55 @@ import (
 )
 
 var output = flag.String("out", "out.bin", "file name for the output")
+var format = flag.String("format", "bin", "output format: "+strings.Join(core.OutputFormatNames(), ", "))
 var arch = flag.String("arch", "dcpu", "Architecture, dcpu, rq or mocha. (default dcpu)")
+var listing = flag.String("listing", "", "file name for an optional listing of the assembly")
+var symbols = flag.String("sym", "", "file name for an optional symbol table")
+var symFormat = flag.String("symformat", "map", "symbol table format, map or json")
+var regionMap = flag.String("map", "", "file name for an optional report of the regions written")
+var fill = flag.Uint("fill", 0, "value for the gaps between regions in the output")
+var sparse = flag.Bool("sparse", false, "write only the regions written, for the ihex and srec formats")
+
+// defines collects -D flags, which can be repeated.
+type defines map[string]uint32
+
+func (d defines) String() string { return "" }
+
+func (d defines) Set(def string) error {
+	name, value := def, uint64(1)
+	if i := strings.Index(def, "="); i >= 0 {
+		name = def[:i]
+		var err error
+		value, err = strconv.ParseUint(def[i+1:], 0, 32)
+		if err != nil {
+			return fmt.Errorf("bad value for %s: %v", name, err)
+		}
+	}
+	if name == "" {
+		return fmt.Errorf("missing symbol name")
+	}
+	d[name] = uint32(value)
+	return nil
+}
+
+var defs = defines{}
+
+// searchPaths collects -I flags, in order.
+type searchPaths []string
+
+func (p *searchPaths) String() string { return strings.Join(*p, ",") }
+
+func (p *searchPaths) Set(dir string) error {
+	*p = append(*p, dir)
+	return nil
+}
+
+var includePaths searchPaths
+
+func init() {
+	flag.Var(defs, "D", "define a symbol, as NAME or NAME=VALUE (default 1); can be repeated")
+	flag.Var(&includePaths, "I", "directory to search for included files; can be repeated")
+}
 
 func main() {
 	flag.Parse()
@@ -19,17 +70,36 @@ func main() {
 	// Grab the first argument and assemble it.
 	file := flag.Arg(0)
 
-	var machine core.Driver
+	var machine core.DriverFactory
 	if *arch == "dcpu" {
-		machine = &dcpu.Driver{}
+		machine = dcpu.NewDriver
 	} else if *arch == "rq" {
-		machine = &rq.Driver{}
+		machine = rq.NewDriver
 	} else if *arch == "mocha" {
-		machine = &mocha.Driver{}
+		machine = mocha.NewDriver
 	} else {
 		fmt.Printf("Unknown arch: %s", *arch)
 		return
 	}
 
-	core.MasterAssembler(machine, file, *output)
+	if *fill > 0xffff {
+		fmt.Printf("-fill must fit in 16 bits: %d\n", *fill)
+		os.Exit(1)
+	}
+	opts := core.Options{Defines: defs, IncludePaths: includePaths, Fill: uint16(*fill)}
+	diags := core.MasterAssembler(machine, file, opts, core.Outputs{
+		Binary:       *output,
+		Format:       *format,
+		Listing:      *listing,
+		Symbols:      *symbols,
+		SymbolFormat: *symFormat,
+		Map:          *regionMap,
+		Sparse:       *sparse,
+	})
+	for _, d := range diags {
+		fmt.Println(d.Error())
+	}
+	if diags.HasErrors() {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/shepheb/drasm/core"
+	"github.com/shepheb/drasm/dcpu"
+	"github.com/shepheb/drasm/mocha"
+	"github.com/shepheb/drasm/rq"
+)
+
+type concurrentCase struct {
+	arch     string
+	machine  core.DriverFactory
+	source   string
+	expected []uint16
+}
+
+var concurrentCases = []concurrentCase{
+	{"dcpu", dcpu.NewDriver, `
+.macro swap=set push, %0 %n set %0, %1 %n set %1, pop
+:main swap a, b
+set pc, main`,
+		[]uint16{0x0301, 0x0401, 0x6021, 0x8781}},
+	{"mocha", mocha.NewDriver, `
+.macro twice=addw %0, %1 %n addw %0, %1
+twice a, b`,
+		[]uint16{0x2001, 0x2001}},
+	{"rq", rq.NewDriver, `
+.def seven, 7
+:main mov r0, #seven
+b main`,
+		[]uint16{0x0807, 0xa1fe}},
+}
+
+// Run with -race: separate Assemblers, even for different machines, must not
+// share any state.
+func TestConcurrentAssemblers(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		for _, c := range concurrentCases {
+			wg.Add(1)
+			go func(c concurrentCase) {
+				defer wg.Done()
+				a := core.NewAssembler(c.machine, core.Options{})
+				res, err := a.Assemble(context.Background(),
+					core.Source{Filename: c.arch, Text: []byte(c.source)})
+				if err != nil {
+					t.Errorf("%s: unexpected error: %v", c.arch, err)
+					return
+				}
+				rom := res.ROM()
+				if len(rom) != len(c.expected) {
+					t.Errorf("%s: expected %d words, got %04x", c.arch, len(c.expected), rom)
+					return
+				}
+				for j, w := range c.expected {
+					if rom[j] != w {
+						t.Errorf("%s: expected word %d to be %04x, got %04x", c.arch, j, w, rom[j])
+					}
+				}
+			}(c)
+		}
+	}
+	wg.Wait()
+}
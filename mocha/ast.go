@@ -221,7 +221,7 @@ func (r *pcRel) Encode(s *core.AssemblyState) *operandBits {
 	if r.offset != nil {
 		value := r.offset.Evaluate(s)
 		if !core.Fits16Signed(value) {
-			core.AsmError(r.offset.Location(),
+			s.Errorf(r.offset.Location(),
 				"PC-relative offset doesn't fit in signed 16-bit value: %d", int32(value))
 		} else {
 			bits.extraWords = []uint16{core.LowWord(value)}
@@ -262,7 +262,7 @@ func (r *spRel) Encode(s *core.AssemblyState) *operandBits {
 
 	value := r.offset.Evaluate(s)
 	if !core.Fits16Signed(value) {
-		core.AsmError(r.offset.Location(), "SP-relative offset does not fit in 16-bit value: %d", value)
+		s.Errorf(r.offset.Location(), "SP-relative offset does not fit in 16-bit value: %d", value)
 	}
 	return &operandBits{mode: 7, regField: 7, extraWords: []uint16{core.LowWord(value)}}
 }
@@ -401,7 +401,7 @@ func (b *binaryLong) Assemble(s *core.AssemblyState) {
 				delta = 0
 				s.MarkDirty()
 			} else {
-				core.AsmError(b.branch.Location(), "Branch target is too far away (-1024 to 1023), need %d", delta)
+				s.Errorf(b.branch.Location(), "Branch target is too far away (-1024 to 1023), need %d", delta)
 			}
 		}
 		nextWord |= uint16(delta << 5)
@@ -434,7 +434,7 @@ func (b *unaryOp) Assemble(s *core.AssemblyState) {
 		base := s.Index() + 1 // Address after this word is written.
 		delta := int32(target) - int32(base)
 		if delta < -65536 || delta > 65535 {
-			core.AsmError(b.branch.Location(), "Branch target is too far away (+/- 64K), need %d", delta)
+			s.Errorf(b.branch.Location(), "Branch target is too far away (+/- 64K), need %d", delta)
 		}
 		s.Push(uint16(delta))
 	}
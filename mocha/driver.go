@@ -4,12 +4,19 @@ import (
 	"io/ioutil"
 
 	"github.com/shepheb/drasm/core"
+	"github.com/shepheb/psec"
 )
 
 // Driver is the host for some methods.
-type Driver struct{}
+type Driver struct {
+	g *psec.Grammar
+}
 
-var pr = buildMochaParser()
+// NewDriver builds a Mocha 86k driver whose parser reports to the given Assembler.
+// It's a core.DriverFactory.
+func NewDriver(a *core.Assembler) core.Driver {
+	return &Driver{g: buildMochaParser(a)}
+}
 
 // ParseFile parses a file by name, returning an AST.
 func (d *Driver) ParseFile(filename string) (*core.AST, error) {
@@ -18,7 +25,7 @@ func (d *Driver) ParseFile(filename string) (*core.AST, error) {
 		return nil, err
 	}
 
-	ast, err := pr.ParseString(filename, string(text))
+	ast, err := d.g.ParseString(filename, string(text))
 	if err != nil {
 		return nil, err
 	}
@@ -26,7 +33,7 @@ func (d *Driver) ParseFile(filename string) (*core.AST, error) {
 }
 
 func (d *Driver) ParseString(filename, text string) (*core.AST, error) {
-	ast, err := pr.ParseString(filename, text)
+	ast, err := d.g.ParseString(filename, text)
 	if err != nil {
 		return nil, err
 	}
@@ -34,7 +41,7 @@ func (d *Driver) ParseString(filename, text string) (*core.AST, error) {
 }
 
 func (d *Driver) ParseExpr(filename, text string) (core.Expression, error) {
-	expr, err := pr.ParseStringWith(filename, text, "expr")
+	expr, err := d.g.ParseStringWith(filename, text, "expr")
 	if err != nil {
 		return nil, err
 	}
@@ -72,10 +72,10 @@ func reservedWords(s string) bool {
 	return false
 }
 
-func buildMochaParser() *psec.Grammar {
+func buildMochaParser(a *core.Assembler) *psec.Grammar {
 	g := psec.NewGrammar()
-	core.AddBasicParsers(g)
-	core.ReservedWords = reservedWords
+	core.AddBasicParsers(g, a)
+	a.SetReservedWords(reservedWords)
 
 	g.WithAction("gpReg", psec.OneOf("ABCXYZIJabcxyzij"),
 		func(r interface{}, loc *psec.Loc) (interface{}, error) {
@@ -7,12 +7,8 @@ import (
 	"github.com/shepheb/psec"
 )
 
-func setup() *psec.Grammar {
-	core.SetDriver(&Driver{})
-	return buildMochaParser()
-}
-
-var mp = setup()
+var testAsm = core.NewAssembler(NewDriver, core.Options{})
+var mp = testAsm.Driver().(*Driver).g
 
 func loc(line, col int) *psec.Loc {
 	return &psec.Loc{Filename: "test", Line: line, Col: col}
@@ -155,7 +151,11 @@ func expectOp(t *testing.T, rule, input string, expected []uint16) {
 	}
 
 	ast := &core.AST{Lines: []core.Assembled{res.(core.Assembled)}}
-	actual := core.AssembleAst(ast)
+	result := testAsm.AssembleAst(ast)
+	actual := result.ROM()
+	if len(result.Diagnostics) > 0 {
+		t.Errorf("unexpected diagnostics %v", result.Diagnostics)
+	}
 
 	if len(actual) != len(expected) {
 		t.Errorf("expected %d assembled words, got %d", len(expected), len(actual))
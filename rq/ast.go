@@ -33,7 +33,7 @@ func (op *instruction) Assemble(s *core.AssemblyState) {
 	} else if f, ok := specialInstructions[op.opcode]; ok {
 		f(op.loc, op.opcode, op.args, s)
 	} else {
-		core.AsmError(op.loc, "Unrecognized opcode: %s", op.opcode)
+		s.Errorf(op.loc, "Unrecognized opcode: %s", op.opcode)
 	}
 }
 
@@ -91,7 +91,7 @@ func (op *loadStore) Assemble(s *core.AssemblyState) {
 	}
 }
 
-// Exits with an error message if the literal won't fit.
+// Reports an error and returns 0 if the literal won't fit.
 func checkLiteral(s *core.AssemblyState, expr core.Expression, signed bool, width uint) uint16 {
 	value := core.Evaluate16(expr, s)
 	loc := expr.Location()
@@ -99,16 +99,16 @@ func checkLiteral(s *core.AssemblyState, expr core.Expression, signed bool, widt
 		if value < (1 << width) {
 			return value
 		}
-		core.AsmError(loc, "Unsigned literal %d (0x%x) is too big for %d-bit literal", value, value, width)
+		s.Errorf(loc, "Unsigned literal %d (0x%x) is too big for %d-bit literal", value, value, width)
 	} else {
 		mask := uint16((1 << width) - 1)
 		// No non-default bits outside the range.
 		if (value|mask) == mask || (value|mask) == 0xffff {
 			return value
 		}
-		core.AsmError(loc, "Signed literal %d (0x%x) doesn't fit in %d-bit literal", value, value, width)
+		s.Errorf(loc, "Signed literal %d (0x%x) doesn't fit in %d-bit literal", value, value, width)
 	}
-	return 0 // Never actually happens.
+	return 0 // The error is already reported.
 }
 
 type stackOp struct {
@@ -112,7 +112,7 @@ func opAddSub(loc *psec.Loc, mnemonic string, args []*arg, s *core.AssemblyState
 		s.Push((opcode << 8) | value)
 	} else {
 		// Unrecognized set of arguments.
-		core.AsmError(loc, "Unrecognized arguments to %s: %s", mnemonic, showArgs(args))
+		s.Errorf(loc, "Unrecognized arguments to %s: %s", mnemonic, showArgs(args))
 	}
 }
 
@@ -126,6 +126,6 @@ func opSWI(loc *psec.Loc, mnemonic string, args []*arg, s *core.AssemblyState) {
 		value := checkLiteral(s, args[0].lit, false, 8)
 		s.Push(0x0200 | value)
 	} else {
-		core.AsmError(loc, "Invalid arguments to SWI: %s", showArgs(args))
+		s.Errorf(loc, "Invalid arguments to SWI: %s", showArgs(args))
 	}
 }
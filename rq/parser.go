@@ -24,9 +24,11 @@ func seq(args ...psec.Parser) psec.Parser {
 	return psec.Seq(args...)
 }
 
-func buildRisqueParser() *psec.Grammar {
+func buildRisqueParser(a *core.Assembler) *psec.Grammar {
 	g := psec.NewGrammar()
-	core.AddBasicParsers(g)
+	core.AddBasicParsers(g, a)
+	// The registers aren't reserved words, so labels can shadow them.
+	a.SetRegisterNames("r0", "r1", "r2", "r3", "r4", "r5", "r6", "r7", "sp", "pc", "lr")
 
 	g.WithAction("gpReg", psec.SeqAt(1, litIC("r"), psec.OneOf("01234567")),
 		func(r interface{}, loc *psec.Loc) (interface{}, error) {
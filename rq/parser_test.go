@@ -7,7 +7,7 @@ import (
 	"github.com/shepheb/psec"
 )
 
-var rp = buildRisqueParser()
+var rp = buildRisqueParser(core.NewAssembler(NewDriver, core.Options{}))
 
 func expectLoadStore(t *testing.T, input string, exp *loadStore) {
 	ast, err := rp.ParseStringWith("test", input, "load-store instruction")